@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"authentication/dbclient"
+	"common/httpx"
+	"common/mq"
+)
+
+func generateCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// sendConfirmationCode replaces the code sent before, so only the latest one
+// is valid.
+func sendConfirmationCode(ctx context.Context, username string, phone string) error {
+	code, err := generateCode()
+	if err != nil {
+		return err
+	}
+	err = db.SetConfirmCode(ctx, username, code, time.Now().Add(conf.ConfirmCodeLifeTime), conf.ConfirmCodeAttempts)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Your confirmation code: %s", code)
+	return sms.Send(ctx, mq.SmsMessage{To: phone, Message: msg})
+}
+
+type postConfirmRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+}
+
+var errCodeNotValid = httpx.NewError(http.StatusBadRequest, "invalid_code", "Code is not valid")
+var errNoCode = httpx.NewError(http.StatusBadRequest, "no_code",
+	"There is no active code, sign in to get a new one")
+
+func postConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	var request postConfirmRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLimit(w, r, "confirm-ip:"+httpx.ClientIP(r), rateLimit{conf.Limits.ConfirmIP, conf.Limits.Window}) {
+		return
+	}
+	err = db.ConfirmPhoneByCode(r.Context(), request.Username, request.Code)
+	if err != nil {
+		switch err {
+		case dbclient.ErrNotFound:
+			err = errNoCode
+		case dbclient.ErrCodeNotValid:
+			err = errCodeNotValid
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, confirmResponse{"Registration has been successfully confirmed"})
+}
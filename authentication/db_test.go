@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"authentication/dbclient"
+)
+
+// connectTestDB connects db to the database in TEST_DATABASE_URL, creating
+// the tables if missing. It returns false when the variable is not set.
+func connectTestDB(t *testing.T) bool {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if len(url) == 0 {
+		return false
+	}
+	var err error
+	db, err = dbclient.CreateDbClient(dbclient.Config{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
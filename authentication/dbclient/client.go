@@ -2,70 +2,166 @@ package dbclient
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
+	"common/metrics"
+	"common/tracing"
+
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+type Config struct {
+	URL string `env:"DATABASE_URL" required:"true" secret:"true"`
+}
+
 type Client struct {
-	connection *pgx.Conn
+	connection *pgxpool.Pool
 }
 
 var ErrNotFound = errors.New("Not found found")
 var ErrUserAlreadyExists = errors.New("User with this username already exists")
 var ErrTokenAlreadyExists = errors.New("")
+var ErrTokenUsed = errors.New("Token has already been used")
 
 func isDuplicateError(err error) bool {
 	return strings.Contains(fmt.Sprint(err), "duplicate key value violates unique constraint")
 }
 
-func CreateDbClient() (Client, error) {
+var schema = []string{
+	`create table if not exists users (
+		username text primary key,
+		pass_hash text not null,
+		phone_number text not null,
+		phone_confirmed boolean not null,
+		permissions text not null
+	);`,
+	`create table if not exists tokens (
+		token_hash text primary key,
+		exp_time timestamp not null,
+		token_type integer not null,
+		username text not null
+	);`,
+	`alter table users add column if not exists pending_phone text not null default '';`,
+	`alter table tokens add column if not exists session_id text not null default '';`,
+	`alter table tokens add column if not exists used boolean not null default false;`,
+	// Tokens used to be stored as is.
+	`do $$ begin
+		lock table tokens in access exclusive mode;
+		if exists (select 1 from information_schema.columns
+			where table_name = 'tokens' and column_name = 'token') then
+			update tokens set token = encode(sha256(convert_to(token, 'UTF8')), 'hex');
+			alter table tokens rename column token to token_hash;
+		end if;
+	end $$;`,
+	`create index if not exists tokens_exp_time on tokens (exp_time);`,
+	`create table if not exists sessions (
+		id text primary key,
+		username text not null,
+		created_at timestamptz not null,
+		last_used_at timestamptz not null,
+		expires_at timestamptz not null,
+		user_agent text not null,
+		ip text not null
+	);`,
+	`create index if not exists sessions_username on sessions (username);`,
+	`create table if not exists confirm_codes (
+		username text primary key,
+		code_hash text not null,
+		expires_at timestamptz not null,
+		attempts_left integer not null
+	);`,
+	`create table if not exists totp (
+		username text primary key,
+		secret text not null,
+		enabled boolean not null,
+		last_step bigint not null
+	);`,
+	`create table if not exists recovery_codes (
+		username text not null,
+		code_hash text not null,
+		primary key (username, code_hash)
+	);`,
+	`create table if not exists rate_limits (
+		key text primary key,
+		window_start timestamptz not null,
+		count integer not null,
+		last_hit timestamptz not null
+	);`,
+	`create table if not exists challenges (
+		token_hash text primary key,
+		username text not null,
+		expires_at timestamptz not null,
+		attempts_left integer not null,
+		sms_code_hash text not null
+	);`,
+	`create table if not exists signing_keys (
+		kid text primary key,
+		private_key bytea not null,
+		created_at timestamptz not null
+	);`,
+	`create table if not exists revocations (
+		id bigserial primary key,
+		username text not null,
+		token_id text not null default '',
+		revoked_at timestamptz not null,
+		expires_at timestamptz not null
+	);`,
+	`create index if not exists revocations_username on revocations (username);`,
+}
+
+func CreateDbClient(conf Config) (Client, error) {
 	db := Client{}
-	conn, err := pgx.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	conn, err := pgxpool.Connect(context.Background(), conf.URL)
 	if err != nil {
 		return Client{}, err
 	}
 	db.connection = conn
-	_, err = db.connection.Exec(context.Background(),
-		`create table if not exists users (
-			username text primary key,
-			pass_hash text not null,
-			phone_number text not null,
-			phone_confirmed boolean not null,
-			permissions text not null
-		);`)
-	if err != nil {
-		return Client{}, err
+	for _, statement := range schema {
+		_, err = db.connection.Exec(context.Background(), statement)
+		if err != nil {
+			conn.Close()
+			return Client{}, err
+		}
 	}
-	_, err = db.connection.Exec(context.Background(),
-		`create table if not exists tokens (
-			token text primary key,
-			exp_time timestamp not null,
-			token_type integer not null,
-			username text not null
-		);`)
-	return db, err
+	return db, nil
 }
 
+func (db *Client) Close() {
+	db.connection.Close()
+}
+
+func (db *Client) Ping(ctx context.Context) error {
+	_, err := db.connection.Exec(ctx, "select 1")
+	return err
+}
+
+// User.PendingPhone is a new phone number waiting for confirmation, the
+// confirmed PhoneNumber is used until then.
 type User struct {
 	Username       string
 	PassHash       string
 	PhoneNumber    string
 	PhoneConfirmed bool
 	Permissions    []string
+	PendingPhone   string
 }
 
-func (db *Client) AddUser(user User) error {
+func (db *Client) AddUser(ctx context.Context, user User) error {
+	defer metrics.ObserveQuery("add_user", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_user")
+	defer span.End()
 	perms, err := json.Marshal(user.Permissions)
 	if err != nil {
 		return err
 	}
-	_, err = db.connection.Exec(context.Background(),
+	_, err = db.connection.Exec(ctx,
 		`insert into users (username, pass_hash, phone_number, phone_confirmed, permissions)
 		values ($1, $2, $3, $4, $5)
 		`, user.Username, user.PassHash, user.PhoneNumber, user.PhoneConfirmed, perms)
@@ -75,13 +171,17 @@ func (db *Client) AddUser(user User) error {
 	return err
 }
 
-func (db *Client) GetUser(username string) (User, error) {
+func (db *Client) GetUser(ctx context.Context, username string) (User, error) {
+	defer metrics.ObserveQuery("get_user", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_user")
+	defer span.End()
 	var user User
 	var perms string
-	err := db.connection.QueryRow(context.Background(),
-		`select username, pass_hash, phone_number, phone_confirmed, permissions from users
+	err := db.connection.QueryRow(ctx,
+		`select username, pass_hash, phone_number, phone_confirmed, permissions, pending_phone from users
 		where username = $1
-		`, username).Scan(&user.Username, &user.PassHash, &user.PhoneNumber, &user.PhoneConfirmed, &perms)
+		`, username).Scan(&user.Username, &user.PassHash, &user.PhoneNumber, &user.PhoneConfirmed, &perms,
+		&user.PendingPhone)
 	if err == pgx.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -95,10 +195,14 @@ func (db *Client) GetUser(username string) (User, error) {
 	return user, nil
 }
 
-func (db *Client) ConfirmPhoneNumber(username string) error {
-	tags, err := db.connection.Exec(context.Background(),
+func (db *Client) ConfirmPhoneNumber(ctx context.Context, username string) error {
+	defer metrics.ObserveQuery("confirm_phone_number", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "confirm_phone_number")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
 		`update users
-		set phone_confirmed = true
+		set phone_number = case when pending_phone <> '' then pending_phone else phone_number end,
+			pending_phone = '', phone_confirmed = true
 		where username = $1
 		`, username)
 	if err == nil && tags.RowsAffected() != 1 {
@@ -107,20 +211,110 @@ func (db *Client) ConfirmPhoneNumber(username string) error {
 	return err
 }
 
-func (db *Client) SetPermissions(username string, permissions []string) error {
+// ChangePhoneNumber sets the number to be confirmed. A confirmed number stays
+// in use until the new one is confirmed, an unconfirmed one is replaced. The
+// confirmation tokens and codes sent before are deleted, so they can't
+// confirm the new number.
+func (db *Client) ChangePhoneNumber(ctx context.Context, username string, phone string) error {
+	defer metrics.ObserveQuery("change_phone_number", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "change_phone_number")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tags, err := tx.Exec(ctx,
+		`update users
+		set pending_phone = case when phone_confirmed then $2 else '' end,
+			phone_number = case when phone_confirmed then phone_number else $2 end
+		where username = $1
+		`, username, phone)
+	if err != nil {
+		return err
+	}
+	if tags.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	_, err = tx.Exec(ctx,
+		`delete from tokens where username = $1 and token_type = $2`, username, CONFIRM)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `delete from confirm_codes where username = $1`, username)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ChangePassword sets the new password and revokes the sessions of the user
+// except keepSession.
+func (db *Client) ChangePassword(ctx context.Context, username string, passHash string, keepSession string, tokensExpire time.Time) error {
+	defer metrics.ObserveQuery("change_password", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "change_password")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tags, err := tx.Exec(ctx,
+		`update users set pass_hash = $1 where username = $2`, passHash, username)
+	if err != nil {
+		return err
+	}
+	if tags.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	err = revokeOtherSessions(ctx, tx, username, keepSession, tokensExpire)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetPermissions revokes the access tokens issued to the user before, since
+// JWT access tokens carry the permissions. The revocation is kept until
+// tokensExpire, when all these tokens have expired.
+func (db *Client) SetPermissions(ctx context.Context, username string, permissions []string, tokensExpire time.Time) error {
+	defer metrics.ObserveQuery("set_permissions", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "set_permissions")
+	defer span.End()
 	perms, err := json.Marshal(permissions)
 	if err != nil {
 		return err
 	}
-	tags, err := db.connection.Exec(context.Background(),
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tags, err := tx.Exec(ctx,
 		`update users
 		set permissions = $1
 		where username = $2
 		 `, perms, username)
-	if err == nil && tags.RowsAffected() != 1 {
-		err = ErrNotFound
+	if err != nil {
+		return err
 	}
-	return err
+	if tags.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	_, err = tx.Exec(ctx,
+		`insert into revocations (username, revoked_at, expires_at)
+		values ($1, $2, $3)`, username, time.Now(), tokensExpire)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// hashToken gives the key tokens are stored by, so a leaked table doesn't
+// leak usable tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 type TokenType int
@@ -129,33 +323,169 @@ const (
 	ACCESS  TokenType = 0
 	REFRESH TokenType = 1
 	CONFIRM TokenType = 2
+	RESET   TokenType = 3
 )
 
+// TokenInfo.SessionID ties the refresh token to the access tokens issued
+// with it and to the refresh tokens it is rotated to, so they are revoked
+// together. Used is set on a rotated refresh token.
 type TokenInfo struct {
-	Token    string
-	ExpTime  time.Time
-	Type     TokenType
-	Username string
-}
-
-func (db *Client) GetTokenInfo(token string) (TokenInfo, error) {
-	var tinfo TokenInfo
-	err := db.connection.QueryRow(context.Background(),
-		`select token, exp_time, token_type, username from tokens
-		where token = $1
-		`, token).Scan(&tinfo.Token, &tinfo.ExpTime, &tinfo.Type, &tinfo.Username)
+	Token     string
+	ExpTime   time.Time
+	Type      TokenType
+	Username  string
+	SessionID string
+	Used      bool
+}
+
+func (db *Client) GetTokenInfo(ctx context.Context, token string) (TokenInfo, error) {
+	defer metrics.ObserveQuery("get_token_info", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_token_info")
+	defer span.End()
+	tinfo := TokenInfo{Token: token}
+	err := db.connection.QueryRow(ctx,
+		`select exp_time, token_type, username, session_id, used from tokens
+		where token_hash = $1
+		`, hashToken(token)).Scan(&tinfo.ExpTime, &tinfo.Type, &tinfo.Username, &tinfo.SessionID, &tinfo.Used)
 	if err == pgx.ErrNoRows {
 		err = ErrNotFound
 	}
 	return tinfo, err
 }
 
-func (db *Client) AddNewToken(tinfo TokenInfo) error {
-	_, err := db.connection.Exec(context.Background(),
-		`insert into tokens (token, exp_time, token_type, username)
-		values($1, $2, $3, $4)`, tinfo.Token, tinfo.ExpTime, tinfo.Type, tinfo.Username)
+func (db *Client) AddNewToken(ctx context.Context, tinfo TokenInfo) error {
+	defer metrics.ObserveQuery("add_new_token", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_new_token")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`insert into tokens (token_hash, exp_time, token_type, username, session_id)
+		values($1, $2, $3, $4, $5)`, hashToken(tinfo.Token), tinfo.ExpTime, tinfo.Type, tinfo.Username, tinfo.SessionID)
 	if isDuplicateError(err) {
 		return ErrTokenAlreadyExists
 	}
 	return err
 }
+
+// RotateToken marks the token as used, adds its replacement and records the
+// use of the session. A token issued before sessions were recorded opens the
+// session. It returns ErrTokenUsed if the token has been rotated before and
+// ErrNotFound if the session has been revoked meanwhile.
+func (db *Client) RotateToken(ctx context.Context, token string, replacement TokenInfo, session Session) error {
+	defer metrics.ObserveQuery("rotate_token", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "rotate_token")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var sessionID string
+	err = tx.QueryRow(ctx,
+		`update tokens
+		set used = true
+		where token_hash = $1 and not used
+		returning session_id`, hashToken(token)).Scan(&sessionID)
+	if err == pgx.ErrNoRows {
+		return ErrTokenUsed
+	}
+	if err != nil {
+		return err
+	}
+	if len(sessionID) == 0 {
+		_, err = tx.Exec(ctx,
+			`insert into sessions (id, username, created_at, last_used_at, expires_at, user_agent, ip)
+			values ($1, $2, $3, $4, $5, $6, $7)`,
+			session.ID, session.Username, session.CreatedAt, session.LastUsedAt, session.ExpiresAt,
+			session.UserAgent, session.IP)
+		if err != nil {
+			return err
+		}
+	} else {
+		tags, err := tx.Exec(ctx,
+			`update sessions
+			set last_used_at = $2, expires_at = $3
+			where id = $1`, session.ID, session.LastUsedAt, session.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if tags.RowsAffected() != 1 {
+			return ErrNotFound
+		}
+	}
+	_, err = tx.Exec(ctx,
+		`insert into tokens (token_hash, exp_time, token_type, username, session_id)
+		values($1, $2, $3, $4, $5)`, hashToken(replacement.Token), replacement.ExpTime, replacement.Type,
+		replacement.Username, replacement.SessionID)
+	if isDuplicateError(err) {
+		return ErrTokenAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteExpiredTokens deletes up to limit expired tokens and returns how many
+// were deleted of each type.
+func (db *Client) DeleteExpiredTokens(ctx context.Context, limit uint) (map[TokenType]int64, error) {
+	defer metrics.ObserveQuery("delete_expired_tokens", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_expired_tokens")
+	defer span.End()
+	rows, err := db.connection.Query(ctx,
+		`delete from tokens
+		where token_hash in (select token_hash from tokens where exp_time < $1 limit $2)
+		returning token_type`, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deleted := make(map[TokenType]int64)
+	for rows.Next() {
+		var t TokenType
+		err := rows.Scan(&t)
+		if err != nil {
+			return nil, err
+		}
+		deleted[t]++
+	}
+	return deleted, rows.Err()
+}
+
+// ResetPassword consumes the password reset token, sets the new password and
+// revokes all sessions of the user.
+func (db *Client) ResetPassword(ctx context.Context, token string, passHash string, tokensExpire time.Time) error {
+	defer metrics.ObserveQuery("reset_password", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "reset_password")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var username string
+	err = tx.QueryRow(ctx,
+		`delete from tokens
+		where token_hash = $1 and token_type = $2 and exp_time > $3
+		returning username`, hashToken(token), RESET, time.Now()).Scan(&username)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`delete from tokens where username = $1 and token_type = $2`, username, RESET)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`update users set pass_hash = $1 where username = $2`, passHash, username)
+	if err != nil {
+		return err
+	}
+	err = revokeUserSessions(ctx, tx, username, tokensExpire)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,96 @@
+package dbclient
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrCodeNotValid is returned for a wrong code. Each check uses an attempt,
+// the code is deleted when no attempts are left.
+var ErrCodeNotValid = errors.New("Code is not valid")
+
+func hashCode(username string, code string) string {
+	return hashToken(username + ":" + code)
+}
+
+// SetConfirmCode replaces the phone confirmation code of the user.
+func (db *Client) SetConfirmCode(ctx context.Context, username string, code string, expires time.Time, attempts uint) error {
+	defer metrics.ObserveQuery("set_confirm_code", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "set_confirm_code")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`insert into confirm_codes (username, code_hash, expires_at, attempts_left)
+		values ($1, $2, $3, $4)
+		on conflict (username) do update
+		set code_hash = excluded.code_hash, expires_at = excluded.expires_at,
+			attempts_left = excluded.attempts_left`, username, hashCode(username, code), expires, attempts)
+	return err
+}
+
+// ConfirmPhoneByCode checks the code and confirms the phone number of the
+// user. It returns ErrNotFound if the user has no active code.
+func (db *Client) ConfirmPhoneByCode(ctx context.Context, username string, code string) error {
+	defer metrics.ObserveQuery("confirm_phone_by_code", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "confirm_phone_by_code")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	// The attempt is taken before the check, so concurrent guesses can't
+	// exceed the limit.
+	var hash string
+	var attemptsLeft int
+	err = tx.QueryRow(ctx,
+		`update confirm_codes
+		set attempts_left = attempts_left - 1
+		where username = $1 and expires_at > $2 and attempts_left > 0
+		returning code_hash, attempts_left`, username, time.Now()).Scan(&hash, &attemptsLeft)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	valid := subtle.ConstantTimeCompare([]byte(hash), []byte(hashCode(username, code))) == 1
+	if valid || attemptsLeft == 0 {
+		_, err = tx.Exec(ctx, `delete from confirm_codes where username = $1`, username)
+		if err != nil {
+			return err
+		}
+	}
+	if !valid {
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		return ErrCodeNotValid
+	}
+	_, err = tx.Exec(ctx,
+		`update users
+		set phone_number = case when pending_phone <> '' then pending_phone else phone_number end,
+			pending_phone = '', phone_confirmed = true
+		where username = $1
+		`, username)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *Client) DeleteExpiredConfirmCodes(ctx context.Context) (int64, error) {
+	defer metrics.ObserveQuery("delete_expired_confirm_codes", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_expired_confirm_codes")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from confirm_codes where expires_at <= $1`, time.Now())
+	return tags.RowsAffected(), err
+}
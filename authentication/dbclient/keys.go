@@ -0,0 +1,129 @@
+package dbclient
+
+import (
+	"context"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
+)
+
+type SigningKey struct {
+	ID         string
+	PrivateKey []byte
+	CreatedAt  time.Time
+}
+
+// GetSigningKeys returns the keys starting with the newest one.
+func (db *Client) GetSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	defer metrics.ObserveQuery("get_signing_keys", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_signing_keys")
+	defer span.End()
+	rows, err := db.connection.Query(ctx,
+		`select kid, private_key, created_at from signing_keys
+		order by created_at desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []SigningKey
+	for rows.Next() {
+		var key SigningKey
+		err := rows.Scan(&key.ID, &key.PrivateKey, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (db *Client) AddSigningKey(ctx context.Context, key SigningKey) error {
+	defer metrics.ObserveQuery("add_signing_key", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_signing_key")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`insert into signing_keys (kid, private_key, created_at)
+		values ($1, $2, $3)`, key.ID, key.PrivateKey, key.CreatedAt)
+	return err
+}
+
+func (db *Client) DeleteSigningKeys(ctx context.Context, createdBefore time.Time) error {
+	defer metrics.ObserveQuery("delete_signing_keys", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_signing_keys")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`delete from signing_keys where created_at < $1`, createdBefore)
+	return err
+}
+
+// Revocation invalidates the access tokens with the token or session id
+// TokenID or, when it is empty, all access tokens of the user issued not later
+// than RevokedAt. It is needed until ExpiresAt, when these tokens have expired
+// anyway.
+type Revocation struct {
+	ID        int64
+	Username  string
+	TokenID   string
+	RevokedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (db *Client) AddRevocation(ctx context.Context, r Revocation) error {
+	defer metrics.ObserveQuery("add_revocation", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_revocation")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`insert into revocations (username, token_id, revoked_at, expires_at)
+		values ($1, $2, $3, $4)`, r.Username, r.TokenID, r.RevokedAt, r.ExpiresAt)
+	return err
+}
+
+// GetRevocations returns the revocations in effect with ids greater than
+// afterID, ordered by id.
+func (db *Client) GetRevocations(ctx context.Context, afterID int64) ([]Revocation, error) {
+	defer metrics.ObserveQuery("get_revocations", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_revocations")
+	defer span.End()
+	rows, err := db.connection.Query(ctx,
+		`select id, username, token_id, revoked_at, expires_at from revocations
+		where id > $1 and expires_at > $2
+		order by id`, afterID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Revocation
+	for rows.Next() {
+		var r Revocation
+		err := rows.Scan(&r.ID, &r.Username, &r.TokenID, &r.RevokedAt, &r.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// IsRevoked checks the revocations of the user and of the given token and
+// session ids.
+func (db *Client) IsRevoked(ctx context.Context, username string, tokenIDs []string, issuedAt time.Time) (bool, error) {
+	defer metrics.ObserveQuery("is_revoked", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "is_revoked")
+	defer span.End()
+	var revoked bool
+	err := db.connection.QueryRow(ctx,
+		`select exists (select 1 from revocations
+		where username = $1 and (token_id <> '' and token_id = any($2) or token_id = '' and revoked_at >= $3))`,
+		username, tokenIDs, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+func (db *Client) DeleteExpiredRevocations(ctx context.Context) error {
+	defer metrics.ObserveQuery("delete_expired_revocations", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_expired_revocations")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`delete from revocations where expires_at <= $1`, time.Now())
+	return err
+}
@@ -0,0 +1,70 @@
+package dbclient
+
+import (
+	"context"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// RateCounter counts events of a key in a fixed window started at Start.
+type RateCounter struct {
+	Count uint
+	Start time.Time
+	Last  time.Time
+}
+
+// HitRateLimit counts an event, starting a new window if the current one is
+// older than window.
+func (db *Client) HitRateLimit(ctx context.Context, key string, window time.Duration) (RateCounter, error) {
+	defer metrics.ObserveQuery("hit_rate_limit", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "hit_rate_limit")
+	defer span.End()
+	now := time.Now()
+	var c RateCounter
+	err := db.connection.QueryRow(ctx,
+		`insert into rate_limits (key, window_start, count, last_hit)
+		values ($1, $2, 1, $2)
+		on conflict (key) do update
+		set window_start = case when rate_limits.window_start <= $3 then $2 else rate_limits.window_start end,
+			count = case when rate_limits.window_start <= $3 then 1 else rate_limits.count + 1 end,
+			last_hit = $2
+		returning count, window_start, last_hit`, key, now, now.Add(-window)).Scan(&c.Count, &c.Start, &c.Last)
+	return c, err
+}
+
+// GetRateLimit returns the counter of the current window, which is zero if
+// the window has passed.
+func (db *Client) GetRateLimit(ctx context.Context, key string, window time.Duration) (RateCounter, error) {
+	defer metrics.ObserveQuery("get_rate_limit", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_rate_limit")
+	defer span.End()
+	var c RateCounter
+	err := db.connection.QueryRow(ctx,
+		`select count, window_start, last_hit from rate_limits
+		where key = $1 and window_start > $2`, key, time.Now().Add(-window)).Scan(&c.Count, &c.Start, &c.Last)
+	if err == pgx.ErrNoRows {
+		return RateCounter{}, nil
+	}
+	return c, err
+}
+
+func (db *Client) ResetRateLimit(ctx context.Context, key string) error {
+	defer metrics.ObserveQuery("reset_rate_limit", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "reset_rate_limit")
+	defer span.End()
+	_, err := db.connection.Exec(ctx, `delete from rate_limits where key = $1`, key)
+	return err
+}
+
+func (db *Client) DeleteRateLimits(ctx context.Context, startedBefore time.Time) (int64, error) {
+	defer metrics.ObserveQuery("delete_rate_limits", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_rate_limits")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from rate_limits where window_start < $1`, startedBefore)
+	return tags.RowsAffected(), err
+}
@@ -0,0 +1,195 @@
+package dbclient
+
+import (
+	"context"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Session is opened by a sign in and lasts while its refresh token is
+// rotated. ExpiresAt is the expiration time of the current refresh token.
+type Session struct {
+	ID         string
+	Username   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	IP         string
+}
+
+// AddSession opens the session with its first refresh token.
+func (db *Client) AddSession(ctx context.Context, session Session, refresh TokenInfo) error {
+	defer metrics.ObserveQuery("add_session", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_session")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`insert into sessions (id, username, created_at, last_used_at, expires_at, user_agent, ip)
+		values ($1, $2, $3, $4, $5, $6, $7)`, session.ID, session.Username, session.CreatedAt,
+		session.LastUsedAt, session.ExpiresAt, session.UserAgent, session.IP)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`insert into tokens (token_hash, exp_time, token_type, username, session_id)
+		values($1, $2, $3, $4, $5)`, hashToken(refresh.Token), refresh.ExpTime, refresh.Type,
+		refresh.Username, refresh.SessionID)
+	if isDuplicateError(err) {
+		return ErrTokenAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *Client) GetSession(ctx context.Context, id string) (Session, error) {
+	defer metrics.ObserveQuery("get_session", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_session")
+	defer span.End()
+	var s Session
+	err := db.connection.QueryRow(ctx,
+		`select id, username, created_at, last_used_at, expires_at, user_agent, ip from sessions
+		where id = $1 and expires_at > $2
+		`, id, time.Now()).Scan(&s.ID, &s.Username, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.UserAgent, &s.IP)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return s, err
+}
+
+// GetSessions returns the active sessions of the user, the most recently
+// used first.
+func (db *Client) GetSessions(ctx context.Context, username string) ([]Session, error) {
+	defer metrics.ObserveQuery("get_sessions", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_sessions")
+	defer span.End()
+	rows, err := db.connection.Query(ctx,
+		`select id, username, created_at, last_used_at, expires_at, user_agent, ip from sessions
+		where username = $1 and expires_at > $2
+		order by last_used_at desc`, username, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Session
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.Username, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.UserAgent, &s.IP)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func (db *Client) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	defer metrics.ObserveQuery("delete_expired_sessions", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_expired_sessions")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from sessions where expires_at <= $1`, time.Now())
+	return tags.RowsAffected(), err
+}
+
+// RevokeSession deletes the refresh and access tokens of the session and
+// records the revocation for JWT access tokens, which are kept until
+// tokensExpire. Tokens issued before sessions were introduced have an empty
+// session id and are revoked together.
+func (db *Client) RevokeSession(ctx context.Context, username string, sessionID string, tokensExpire time.Time) error {
+	defer metrics.ObserveQuery("revoke_session", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "revoke_session")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`delete from tokens
+		where username = $1 and session_id = $2 and token_type in ($3, $4)
+		`, username, sessionID, ACCESS, REFRESH)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`delete from sessions where username = $1 and id = $2`, username, sessionID)
+	if err != nil {
+		return err
+	}
+	if len(sessionID) != 0 {
+		_, err = tx.Exec(ctx,
+			`insert into revocations (username, token_id, revoked_at, expires_at)
+			values ($1, $2, $3, $4)`, username, sessionID, time.Now(), tokensExpire)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// RevokeUserSessions revokes every refresh and access token of the user.
+func (db *Client) RevokeUserSessions(ctx context.Context, username string, tokensExpire time.Time) error {
+	defer metrics.ObserveQuery("revoke_user_sessions", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "revoke_user_sessions")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	err = revokeUserSessions(ctx, tx, username, tokensExpire)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func revokeUserSessions(ctx context.Context, tx pgx.Tx, username string, tokensExpire time.Time) error {
+	_, err := tx.Exec(ctx,
+		`delete from tokens
+		where username = $1 and token_type in ($2, $3)
+		`, username, ACCESS, REFRESH)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`delete from sessions where username = $1`, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`insert into revocations (username, revoked_at, expires_at)
+		values ($1, $2, $3)`, username, time.Now(), tokensExpire)
+	return err
+}
+
+func revokeOtherSessions(ctx context.Context, tx pgx.Tx, username string, keepSession string, tokensExpire time.Time) error {
+	_, err := tx.Exec(ctx,
+		`insert into revocations (username, token_id, revoked_at, expires_at)
+		select username, id, $3, $4 from sessions
+		where username = $1 and id <> $2`, username, keepSession, time.Now(), tokensExpire)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`delete from tokens
+		where username = $1 and session_id <> $2 and token_type in ($3, $4)
+		`, username, keepSession, ACCESS, REFRESH)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`delete from sessions where username = $1 and id <> $2`, username, keepSession)
+	return err
+}
@@ -0,0 +1,265 @@
+package dbclient
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrTOTPEnabled = errors.New("Two-factor authentication is already enabled")
+
+// TOTP is the authenticator secret of the user. It is used at sign in once
+// Enabled, LastStep keeps a code from being used twice.
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// SetupTOTP stores a new secret waiting for the first code. It returns
+// ErrTOTPEnabled if the user already uses two-factor authentication.
+func (db *Client) SetupTOTP(ctx context.Context, username string, secret string) error {
+	defer metrics.ObserveQuery("setup_totp", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "setup_totp")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`insert into totp (username, secret, enabled, last_step)
+		values ($1, $2, false, 0)
+		on conflict (username) do update
+		set secret = excluded.secret, last_step = 0
+		where not totp.enabled`, username, secret)
+	if err == nil && tags.RowsAffected() != 1 {
+		err = ErrTOTPEnabled
+	}
+	return err
+}
+
+func (db *Client) GetTOTP(ctx context.Context, username string) (TOTP, error) {
+	defer metrics.ObserveQuery("get_totp", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_totp")
+	defer span.End()
+	var t TOTP
+	err := db.connection.QueryRow(ctx,
+		`select secret, enabled, last_step from totp where username = $1`,
+		username).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return t, err
+}
+
+// UseTOTPStep records the use of the code of the time step. It returns false
+// if a code of this or a later step has been used.
+func (db *Client) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	defer metrics.ObserveQuery("use_totp_step", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "use_totp_step")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`update totp set last_step = $2
+		where username = $1 and last_step < $2`, username, step)
+	if err != nil {
+		return false, err
+	}
+	return tags.RowsAffected() == 1, nil
+}
+
+// EnableTOTP turns on two-factor authentication with the given recovery
+// codes.
+func (db *Client) EnableTOTP(ctx context.Context, username string, recoveryCodes []string) error {
+	defer metrics.ObserveQuery("enable_totp", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "enable_totp")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tags, err := tx.Exec(ctx,
+		`update totp set enabled = true where username = $1 and not enabled`, username)
+	if err != nil {
+		return err
+	}
+	if tags.RowsAffected() != 1 {
+		return ErrTOTPEnabled
+	}
+	err = setRecoveryCodes(ctx, tx, username, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DisableTOTP deletes the secret and the recovery codes of the user.
+func (db *Client) DisableTOTP(ctx context.Context, username string) error {
+	defer metrics.ObserveQuery("disable_totp", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "disable_totp")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `delete from totp where username = $1`, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `delete from recovery_codes where username = $1`, username)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetRecoveryCodes replaces the recovery codes of the user.
+func (db *Client) SetRecoveryCodes(ctx context.Context, username string, codes []string) error {
+	defer metrics.ObserveQuery("set_recovery_codes", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "set_recovery_codes")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	err = setRecoveryCodes(ctx, tx, username, codes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func setRecoveryCodes(ctx context.Context, tx pgx.Tx, username string, codes []string) error {
+	_, err := tx.Exec(ctx, `delete from recovery_codes where username = $1`, username)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec(ctx,
+			`insert into recovery_codes (username, code_hash) values ($1, $2)`,
+			username, hashCode(username, code))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode deletes the recovery code and tells if it existed.
+func (db *Client) UseRecoveryCode(ctx context.Context, username string, code string) (bool, error) {
+	defer metrics.ObserveQuery("use_recovery_code", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "use_recovery_code")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from recovery_codes where username = $1 and code_hash = $2`,
+		username, hashCode(username, code))
+	if err != nil {
+		return false, err
+	}
+	return tags.RowsAffected() == 1, nil
+}
+
+// Challenge is the second step of a sign in with two-factor authentication.
+// SMSCodeHash is set once a code has been sent by SMS.
+type Challenge struct {
+	Token        string
+	Username     string
+	ExpiresAt    time.Time
+	AttemptsLeft uint
+	SMSCodeHash  string
+}
+
+func (db *Client) AddChallenge(ctx context.Context, c Challenge) error {
+	defer metrics.ObserveQuery("add_challenge", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "add_challenge")
+	defer span.End()
+	_, err := db.connection.Exec(ctx,
+		`insert into challenges (token_hash, username, expires_at, attempts_left, sms_code_hash)
+		values ($1, $2, $3, $4, '')`, hashToken(c.Token), c.Username, c.ExpiresAt, c.AttemptsLeft)
+	return err
+}
+
+// TakeChallengeAttempt uses an attempt of the challenge before a code is
+// checked. It returns ErrNotFound if the challenge has expired or has no
+// attempts left.
+func (db *Client) TakeChallengeAttempt(ctx context.Context, token string) (Challenge, error) {
+	defer metrics.ObserveQuery("take_challenge_attempt", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "take_challenge_attempt")
+	defer span.End()
+	c := Challenge{Token: token}
+	err := db.connection.QueryRow(ctx,
+		`update challenges
+		set attempts_left = attempts_left - 1
+		where token_hash = $1 and expires_at > $2 and attempts_left > 0
+		returning username, expires_at, attempts_left, sms_code_hash`,
+		hashToken(token), time.Now()).Scan(&c.Username, &c.ExpiresAt, &c.AttemptsLeft, &c.SMSCodeHash)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return c, err
+}
+
+// SetChallengeSMSCode stores the code sent by SMS. It returns ErrNotFound if
+// the challenge has expired or a code has been sent already.
+func (db *Client) SetChallengeSMSCode(ctx context.Context, token string, username string, code string) error {
+	defer metrics.ObserveQuery("set_challenge_sms_code", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "set_challenge_sms_code")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`update challenges set sms_code_hash = $2
+		where token_hash = $1 and expires_at > $3 and attempts_left > 0 and sms_code_hash = ''`,
+		hashToken(token), hashCode(username, code), time.Now())
+	if err == nil && tags.RowsAffected() != 1 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// GetChallenge returns an active challenge without using an attempt.
+func (db *Client) GetChallenge(ctx context.Context, token string) (Challenge, error) {
+	defer metrics.ObserveQuery("get_challenge", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_challenge")
+	defer span.End()
+	c := Challenge{Token: token}
+	err := db.connection.QueryRow(ctx,
+		`select username, expires_at, attempts_left, sms_code_hash from challenges
+		where token_hash = $1 and expires_at > $2 and attempts_left > 0`,
+		hashToken(token), time.Now()).Scan(&c.Username, &c.ExpiresAt, &c.AttemptsLeft, &c.SMSCodeHash)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return c, err
+}
+
+// DeleteChallenge completes the challenge. It returns ErrNotFound if it has
+// been completed by a concurrent request.
+func (db *Client) DeleteChallenge(ctx context.Context, token string) error {
+	defer metrics.ObserveQuery("delete_challenge", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_challenge")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from challenges where token_hash = $1`, hashToken(token))
+	if err == nil && tags.RowsAffected() != 1 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+func (db *Client) DeleteExpiredChallenges(ctx context.Context) (int64, error) {
+	defer metrics.ObserveQuery("delete_expired_challenges", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_expired_challenges")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from challenges where expires_at <= $1`, time.Now())
+	return tags.RowsAffected(), err
+}
+
+// CheckSMSCode compares the code with the one sent for the challenge.
+func CheckSMSCode(c Challenge, code string) bool {
+	return len(c.SMSCodeHash) != 0 &&
+		subtle.ConstantTimeCompare([]byte(c.SMSCodeHash), []byte(hashCode(c.Username, code))) == 1
+}
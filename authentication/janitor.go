@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"authentication/dbclient"
+	"common/logging"
+	"common/metrics"
+)
+
+var tokenTypeNames = map[dbclient.TokenType]string{
+	dbclient.ACCESS:  "access",
+	dbclient.REFRESH: "refresh",
+	dbclient.CONFIRM: "confirm",
+	dbclient.RESET:   "reset",
+}
+
+// cleanTokens deletes expired tokens in batches, so a large backlog doesn't
+// hold locks for long, and then expired sessions, confirmation codes, sign
+// in challenges and rate limit counters.
+func cleanTokens(ctx context.Context) error {
+	for {
+		deleted, err := db.DeleteExpiredTokens(ctx, conf.CleanupBatchSize)
+		if err != nil {
+			return err
+		}
+		var total int64
+		for t, count := range deleted {
+			metrics.TokensDeleted(tokenTypeNames[t], count)
+			total += count
+		}
+		if total < int64(conf.CleanupBatchSize) {
+			break
+		}
+	}
+	deleted, err := db.DeleteExpiredSessions(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.TokensDeleted("session", deleted)
+	deleted, err = db.DeleteExpiredConfirmCodes(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.TokensDeleted("confirm_code", deleted)
+	deleted, err = db.DeleteExpiredChallenges(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.TokensDeleted("challenge", deleted)
+	return limits.prune(ctx)
+}
+
+func runJanitor(period time.Duration) {
+	for range time.Tick(period) {
+		err := cleanTokens(context.Background())
+		metrics.JanitorRun(err)
+		if err != nil {
+			logging.Error("Failed to delete expired tokens", logging.Fields{"error": err})
+		}
+	}
+}
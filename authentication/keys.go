@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"authentication/dbclient"
+	"common/auth"
+	"common/httpx"
+	"common/logging"
+)
+
+// keyring holds the keys access tokens are signed with. All instances share
+// them through the database: a new key is created once the newest one is
+// older than the rotation period, and old keys are kept while tokens signed
+// with them may still be valid.
+type keyring struct {
+	mutex sync.RWMutex
+	keys  []dbclient.SigningKey
+}
+
+var keys keyring
+
+func (k *keyring) load(ctx context.Context) error {
+	loaded, err := db.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	k.keys = loaded
+	k.mutex.Unlock()
+	return nil
+}
+
+func (k *keyring) rotate(ctx context.Context) error {
+	err := k.load(ctx)
+	if err != nil {
+		return err
+	}
+	k.mutex.RLock()
+	fresh := len(k.keys) != 0 && time.Since(k.keys[0].CreatedAt) < conf.KeyRotationPeriod
+	k.mutex.RUnlock()
+	if !fresh {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		key := dbclient.SigningKey{ID: generateToken(16), PrivateKey: private, CreatedAt: time.Now()}
+		err = db.AddSigningKey(ctx, key)
+		if err != nil {
+			return err
+		}
+		logging.Info("Created signing key", logging.Fields{"kid": key.ID})
+	}
+	err = db.DeleteSigningKeys(ctx, time.Now().Add(-conf.KeyRotationPeriod-conf.AccessTokenLifeTime))
+	if err != nil {
+		return err
+	}
+	err = db.DeleteExpiredRevocations(ctx)
+	if err != nil {
+		return err
+	}
+	return k.load(ctx)
+}
+
+func (k *keyring) signer() auth.SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return auth.SigningKey{ID: k.keys[0].ID, Private: k.keys[0].PrivateKey}
+}
+
+func (k *keyring) publicKey(kid string) (ed25519.PublicKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return ed25519.PrivateKey(key.PrivateKey).Public().(ed25519.PublicKey), true
+		}
+	}
+	return nil, false
+}
+
+func (k *keyring) jwks() auth.JWKS {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	set := auth.JWKS{Keys: []auth.JWK{}}
+	for _, key := range k.keys {
+		public := ed25519.PrivateKey(key.PrivateKey).Public().(ed25519.PublicKey)
+		set.Keys = append(set.Keys, auth.PublicJWK(key.ID, public))
+	}
+	return set
+}
+
+func runKeyRotation(period time.Duration) {
+	for range time.Tick(period) {
+		err := keys.rotate(context.Background())
+		if err != nil {
+			logging.Error("Failed to rotate signing keys", logging.Fields{"error": err})
+		}
+	}
+}
+
+// getJWKSHandler reads the keys from the database, so keys created by other
+// instances are published at once.
+func getJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	err := keys.load(r.Context())
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, keys.jwks())
+}
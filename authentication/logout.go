@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"authentication/dbclient"
+	"common/auth"
+	"common/httpx"
+)
+
+// accessInfo describes a valid access token. TokenID is set for JWT tokens
+// only, SessionID is empty for tokens issued before sessions were introduced.
+type accessInfo struct {
+	Username  string
+	SessionID string
+	TokenID   string
+	ExpiresAt time.Time
+}
+
+func getAccessInfo(ctx context.Context, token string) (accessInfo, error) {
+	if !auth.IsJWT(token) {
+		tinfo, err := getAccessTokenInfo(ctx, token)
+		if err != nil {
+			return accessInfo{}, err
+		}
+		return accessInfo{tinfo.Username, tinfo.SessionID, "", tinfo.ExpTime}, nil
+	}
+	claims, err := parseJWT(ctx, token)
+	if err != nil {
+		return accessInfo{}, err
+	}
+	return accessInfo{claims.Subject, claims.SessionID, claims.ID, time.Unix(claims.ExpiresAt, 0)}, nil
+}
+
+type postLogoutResponse struct{}
+
+// postLogoutHandler revokes the session of the presented access token: the
+// refresh token and all access tokens issued with it.
+func postLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := getAccessInfo(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if len(info.SessionID) == 0 && len(info.TokenID) != 0 {
+		err = db.AddRevocation(r.Context(), dbclient.Revocation{
+			Username:  info.Username,
+			TokenID:   info.TokenID,
+			RevokedAt: time.Now(),
+			ExpiresAt: info.ExpiresAt,
+		})
+	} else {
+		err = db.RevokeSession(r.Context(), info.Username, info.SessionID, time.Now().Add(conf.AccessTokenLifeTime))
+	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postLogoutResponse{})
+}
+
+type postLogoutAllResponse struct{}
+
+func postLogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.RevokeUserSessions(r.Context(), user.Username, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postLogoutAllResponse{})
+}
+
+type postRevokeSessionsRequest struct {
+	Username string `json:"username"`
+}
+
+type postRevokeSessionsResponse struct{}
+
+func postRevokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	var request postRevokeSessionsRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	_, err = db.GetUser(r.Context(), request.Username)
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = httpx.NotFound(err)
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.RevokeUserSessions(r.Context(), request.Username, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postRevokeSessionsResponse{})
+}
@@ -1,55 +1,70 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	"authentication/dbclient"
-	"authentication/mqclient"
+	"common/auth"
+	"common/config"
+	"common/health"
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
+	"common/mq"
+	"common/shutdown"
+	"common/tracing"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 var db dbclient.Client
-var mq mqclient.Client
+var sms mq.SmsPublisher
 
 type Config struct {
-	TokenLength          uint
-	RefreshTokenLifeTime time.Duration
-	AccessTokenLifeTime  time.Duration
-	ConfirmTokenLifeTime time.Duration
-	ConfirmAddress       string
+	HTTPAddress          string        `env:"HTTP_ADDRESS" default:":8080"`
+	RPCAddress           string        `env:"RPC_ADDRESS" default:":5300"`
+	TokenLength          uint          `env:"TOKEN_LENGTH" default:"20" min:"8" max:"256"`
+	RefreshTokenLifeTime time.Duration `env:"REFRESH_TOKEN_LIFE_TIME" default:"24h" min:"1m"`
+	AccessTokenLifeTime  time.Duration `env:"ACCESS_TOKEN_LIFE_TIME" default:"30m" min:"1m"`
+	ConfirmTokenLifeTime time.Duration `env:"CONFIRM_TOKEN_LIFE_TIME" default:"12h" min:"1m"`
+	// In the link mode users confirm the phone number by following a link to
+	// CONFIRM_ADDRESS, in the code mode by entering a numeric code.
+	ConfirmMode         string        `env:"CONFIRM_MODE" default:"link" oneof:"link,code"`
+	ConfirmAddress      string        `env:"CONFIRM_ADDRESS"`
+	ConfirmCodeLifeTime time.Duration `env:"CONFIRM_CODE_LIFE_TIME" default:"10m" min:"1m"`
+	ConfirmCodeAttempts uint          `env:"CONFIRM_CODE_ATTEMPTS" default:"5" min:"1" max:"100"`
+	// AccessTokenFormat is "jwt" for signed tokens that services verify
+	// without calling the server.
+	AccessTokenFormat string        `env:"ACCESS_TOKEN_FORMAT" default:"opaque" oneof:"opaque,jwt"`
+	KeyRotationPeriod time.Duration `env:"JWT_KEY_ROTATION_PERIOD" default:"24h" min:"1m"`
+	// Password reset codes are limited per username and per client IP.
+	ResetTokenLifeTime   time.Duration `env:"RESET_TOKEN_LIFE_TIME" default:"15m" min:"1m"`
+	PasswordResetLimit   uint          `env:"PASSWORD_RESET_LIMIT" default:"3" min:"1"`
+	PasswordResetIPLimit uint          `env:"PASSWORD_RESET_IP_LIMIT" default:"20" min:"1"`
+	PasswordResetWindow  time.Duration `env:"PASSWORD_RESET_WINDOW" default:"1h" min:"1s" max:"24h"`
+	TOTPIssuer           string        `env:"TOTP_ISSUER" default:"dist-sys"`
+	ChallengeLifeTime    time.Duration `env:"TWO_FACTOR_CHALLENGE_LIFE_TIME" default:"5m" min:"1m"`
+	ChallengeAttempts    uint          `env:"TWO_FACTOR_ATTEMPTS" default:"5" min:"1" max:"100"`
+	CleanupInterval      time.Duration `env:"TOKEN_CLEANUP_INTERVAL" default:"10m" min:"1s"`
+	CleanupBatchSize     uint          `env:"TOKEN_CLEANUP_BATCH_SIZE" default:"1000" min:"1" max:"100000"`
+
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+	Database dbclient.Config
+	MQ       mq.Config
+	CORS     httpx.CORSConfig
+	Proxy    httpx.ProxyConfig
+	Limits   LimitsConfig
 }
 
 var conf Config
 
-func (c *Config) Load() error {
-	tlen, err := strconv.ParseUint(os.Getenv("TOKEN_LENGTH"), 10, 64)
-	c.TokenLength = uint(tlen)
-	c.RefreshTokenLifeTime, err = time.ParseDuration(os.Getenv("REFRESH_TOKEN_LIFE_TIME"))
-	if err != nil {
-		return err
-	}
-	c.AccessTokenLifeTime, err = time.ParseDuration(os.Getenv("ACCESS_TOKEN_LIFE_TIME"))
-	if err != nil {
-		return err
-	}
-	c.ConfirmTokenLifeTime, err = time.ParseDuration(os.Getenv("CONFIRM_TOKEN_LIFE_TIME"))
-	if err != nil {
-		return err
-	}
-	c.ConfirmAddress = os.Getenv("CONFIRM_ADDRESS")
-	return nil
-}
-
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
 	return string(bytes), err
@@ -60,57 +75,67 @@ func checkPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
+// dummyPasswordHash has the cost of hashPassword and matches no password.
+// Checking it for unknown users makes their sign in as slow as for existing
+// ones.
+const dummyPasswordHash = "$2a$14$mxPkgynrOI73MwEgeNowQ./aXLyoSB1wyfdSZG2nW/Jdg0FZ5O06i"
+
 func generateToken(lenght uint) string {
 	b := make([]byte, (lenght+1)/2)
 	rand.Read(b)
 	return fmt.Sprintf("%x", b)
 }
 
-func respondOK(w http.ResponseWriter, result interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+func errWrongTokenType(expected string) error {
+	return httpx.NewError(http.StatusBadRequest, "wrong_token_type", "Should provide "+expected+" token")
 }
 
-type errorResponse struct {
-	Error string `json:"error"`
+func requirePermission(perm string) httpx.Middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			perms, err := doValidate(r.Context(), r.Header.Get("auth"))
+			if err != nil {
+				httpx.RespondError(w, r, err)
+				return
+			}
+			if !auth.UserPermissions(perms).Has(perm) {
+				httpx.RespondError(w, r, auth.ErrForbidden)
+				return
+			}
+			h(w, r)
+		}
+	}
 }
 
-func respondWithError(w http.ResponseWriter, err error, statusCode int) {
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(errorResponse{fmt.Sprint(err)})
-}
+var errResendCooldown = httpx.NewError(http.StatusTooManyRequests, "too_many_requests",
+	"Confirmation has been sent recently, try again later")
 
-func checkPermission(w http.ResponseWriter, r *http.Request, perm string) bool {
-	token := r.Header.Get("auth")
-	perms, err := doValidate(token)
+// sendConfirmationMessage sends at most one message per CONFIRM_RESEND_COOLDOWN
+// to the user and returns errResendCooldown otherwise.
+func sendConfirmationMessage(ctx context.Context, username string, phone string) error {
+	c, err := limits.hit(ctx, resendKey(username), conf.Limits.ResendPeriod)
 	if err != nil {
-		respondWithError(w, err, http.StatusUnauthorized)
-		return false
+		return err
 	}
-	for _, p := range perms.Permissions {
-		if p == perm {
-			return true
-		}
+	if c.Count > 1 {
+		return errResendCooldown
+	}
+	if conf.ConfirmMode == "code" {
+		return sendConfirmationCode(ctx, username, phone)
 	}
-	respondWithError(w, errors.New("Not enough permissions"), http.StatusForbidden)
-	return false
-}
-
-func sendConfirmationMessage(username string, phone string) error {
 	token := generateToken(conf.TokenLength)
 	tinfo := dbclient.TokenInfo{
-		token,
-		time.Now().Add(conf.ConfirmTokenLifeTime),
-		dbclient.CONFIRM,
-		username,
+		Token:    token,
+		ExpTime:  time.Now().Add(conf.ConfirmTokenLifeTime),
+		Type:     dbclient.CONFIRM,
+		Username: username,
 	}
-	err := db.AddNewToken(tinfo)
+	err = db.AddNewToken(ctx, tinfo)
 	if err != nil {
 		return err
 	}
 	msg := fmt.Sprintf("To confirm registration folow the link: %s/%s", conf.ConfirmAddress, token)
-	err = mq.SendMessage(mqclient.Message{phone, msg})
+	err = sms.Send(ctx, mq.SmsMessage{To: phone, Message: msg})
 	if err != nil {
 		return err
 	}
@@ -129,14 +154,17 @@ type postSignUpResponse struct {
 
 func postSignUpHandler(w http.ResponseWriter, r *http.Request) {
 	var request postSignUpRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err := httpx.DecodeJSON(r, &request)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLimit(w, r, "signup-ip:"+httpx.ClientIP(r), rateLimit{conf.Limits.SignUpIP, conf.Limits.Window}) {
 		return
 	}
 	hash, err := hashPassword(request.Password)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
 	var user dbclient.User
@@ -145,32 +173,20 @@ func postSignUpHandler(w http.ResponseWriter, r *http.Request) {
 	user.PhoneNumber = request.PhoneNumber
 	user.PhoneConfirmed = false
 	user.Permissions = append(user.Permissions, "read")
-	err = db.AddUser(user)
+	err = db.AddUser(r.Context(), user)
 	if err != nil {
-		switch err {
-		case dbclient.ErrUserAlreadyExists:
-			respondWithError(w, err, http.StatusBadRequest)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
+		if err == dbclient.ErrUserAlreadyExists {
+			err = httpx.NewError(http.StatusConflict, "user_exists", err.Error())
 		}
+		httpx.RespondError(w, r, err)
 		return
 	}
-	err = sendConfirmationMessage(user.Username, user.PhoneNumber)
+	err = sendConfirmationMessage(r.Context(), user.Username, user.PhoneNumber)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, postSignUpResponse{"We sent the confirmation link to your phone."})
-}
-
-func generalSignUpHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "POST":
-		postSignUpHandler(w, r)
-	default:
-		w.Header().Add("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+	httpx.RespondOK(w, postSignUpResponse{"We sent the confirmation " + conf.ConfirmMode + " to your phone."})
 }
 
 type postSignInRequest struct {
@@ -178,105 +194,145 @@ type postSignInRequest struct {
 	Password string `json:"password"`
 }
 
+// postSignInResponse has only ChallengeToken set when the user has to pass
+// two-factor authentication.
 type postSignInResponse struct {
-	RefreshToken string `json:"refresh_token"`
-	AccessToken  string `json:"access_token"`
+	RefreshToken   string `json:"refresh_token,omitempty"`
+	AccessToken    string `json:"access_token,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
 }
 
-var ErrNotValid = errors.New("Username or password is not valid")
-var ErrPhoneNotConfirmed = errors.New("Your phone number is not confirmed. Follow the link in the sms")
+var ErrNotValid = httpx.NewError(http.StatusUnauthorized, "invalid_credentials",
+	"Username or password is not valid")
+var ErrPhoneNotConfirmed = httpx.NewError(http.StatusForbidden, "phone_not_confirmed",
+	"Your phone number is not confirmed. Use the confirmation we sent in the sms")
 
 func postSignInHandler(w http.ResponseWriter, r *http.Request) {
 	var request postSignInRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err := httpx.DecodeJSON(r, &request)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	user, err := db.GetUser(request.Username)
-	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, ErrNotValid, http.StatusUnauthorized)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
-		}
+	window := conf.Limits.Window
+	if !checkLimit(w, r, "signin-ip:"+httpx.ClientIP(r), rateLimit{conf.Limits.SignInIP, window}) ||
+		!checkLimit(w, r, "signin-user:"+request.Username, rateLimit{conf.Limits.SignInUser, window}) ||
+		!checkLockout(w, r, request.Username) {
 		return
 	}
-	if !checkPasswordHash(request.Password, user.PassHash) {
-		respondWithError(w, ErrNotValid, http.StatusUnauthorized)
+	user, err := db.GetUser(r.Context(), request.Username)
+	if err == dbclient.ErrNotFound {
+		checkPasswordHash(request.Password, dummyPasswordHash)
+	}
+	if err == dbclient.ErrNotFound || err == nil && !checkPasswordHash(request.Password, user.PassHash) {
+		err = signInFailed(r.Context(), request.Username)
+		if err == nil {
+			err = ErrNotValid
+		}
+	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
 		return
 	}
 	if !user.PhoneConfirmed {
-		err = sendConfirmationMessage(user.Username, user.PhoneNumber)
-		if err != nil {
-			respondWithError(w, err, http.StatusInternalServerError)
+		err = sendConfirmationMessage(r.Context(), user.Username, user.PhoneNumber)
+		if err != nil && err != errResendCooldown {
+			httpx.RespondError(w, r, err)
 			return
 		}
-		respondWithError(w, ErrPhoneNotConfirmed, http.StatusForbidden)
+		httpx.RespondError(w, r, ErrPhoneNotConfirmed)
 		return
 	}
-	refresh := generateToken(conf.TokenLength)
-	access := generateToken(conf.TokenLength)
-	rtinfo := dbclient.TokenInfo{
-		refresh,
-		time.Now().Add(conf.RefreshTokenLifeTime),
-		dbclient.REFRESH,
-		request.Username,
+	totp, err := db.GetTOTP(r.Context(), user.Username)
+	if err != nil && err != dbclient.ErrNotFound {
+		httpx.RespondError(w, r, err)
+		return
 	}
-	atinfo := dbclient.TokenInfo{
-		access,
-		time.Now().Add(conf.AccessTokenLifeTime),
-		dbclient.ACCESS,
-		request.Username,
+	if err == nil && totp.Enabled {
+		challenge, err := startChallenge(r.Context(), user.Username)
+		if err != nil {
+			httpx.RespondError(w, r, err)
+			return
+		}
+		httpx.RespondOK(w, postSignInResponse{ChallengeToken: challenge})
+		return
 	}
-	err = db.AddNewToken(rtinfo)
+	err = signInSucceeded(r.Context(), user.Username)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	err = db.AddNewToken(atinfo)
+	response, err := startSession(r, user)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, postSignInResponse{refresh, access})
+	httpx.RespondOK(w, response)
 }
 
-func generalSignInHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "POST":
-		postSignInHandler(w, r)
-	default:
-		w.Header().Add("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// startSession opens a session for the signed in user and issues its tokens.
+func startSession(r *http.Request, user dbclient.User) (postSignInResponse, error) {
+	refresh := generateToken(conf.TokenLength)
+	rtinfo := dbclient.TokenInfo{
+		Token:     refresh,
+		ExpTime:   time.Now().Add(conf.RefreshTokenLifeTime),
+		Type:      dbclient.REFRESH,
+		Username:  user.Username,
+		SessionID: generateToken(32),
+	}
+	session := dbclient.Session{
+		ID:         rtinfo.SessionID,
+		Username:   user.Username,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  rtinfo.ExpTime,
+		UserAgent:  r.UserAgent(),
+		IP:         httpx.ClientIP(r),
+	}
+	err := db.AddSession(r.Context(), session, rtinfo)
+	if err != nil {
+		return postSignInResponse{}, err
 	}
+	access, err := issueAccessToken(r.Context(), user.Username, user.Permissions, rtinfo.SessionID)
+	if err != nil {
+		return postSignInResponse{}, err
+	}
+	return postSignInResponse{RefreshToken: refresh, AccessToken: access}, nil
 }
 
 type getValidateRequest struct{}
 
-type getValidateResponse struct {
-	Username    string   `json:"username"`
-	Permissions []string `json:"permissions"`
-}
-
-func doValidate(token string) (getValidateResponse, error) {
-	tinfo, err := db.GetTokenInfo(token)
+func getAccessTokenInfo(ctx context.Context, token string) (dbclient.TokenInfo, error) {
+	tinfo, err := db.GetTokenInfo(ctx, token)
 	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			return getValidateResponse{}, errors.New("Token is not valid")
-		default:
-			return getValidateResponse{}, err
+		if err == dbclient.ErrNotFound {
+			err = auth.ErrInvalidToken
 		}
+		return tinfo, err
 	}
 	if tinfo.Type != dbclient.ACCESS {
-		return getValidateResponse{}, errors.New("Should provide access token")
+		return tinfo, errWrongTokenType("access")
 	}
 	if tinfo.ExpTime.Before(time.Now()) {
-		return getValidateResponse{}, errors.New("Token has expired")
+		return tinfo, auth.ErrTokenExpired
 	}
-	uinfo, err := db.GetUser(tinfo.Username)
+	return tinfo, nil
+}
+
+type getValidateResponse struct {
+	Username    string   `json:"username"`
+	Permissions []string `json:"permissions"`
+}
+
+func doValidate(ctx context.Context, token string) (getValidateResponse, error) {
+	if auth.IsJWT(token) {
+		return validateJWT(ctx, token)
+	}
+	tinfo, err := getAccessTokenInfo(ctx, token)
+	if err != nil {
+		return getValidateResponse{}, err
+	}
+	uinfo, err := db.GetUser(ctx, tinfo.Username)
 	if err != nil {
 		return getValidateResponse{}, err
 	}
@@ -289,22 +345,12 @@ func doValidate(token string) (getValidateResponse, error) {
 
 func getValidateHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.Header.Get("auth")
-	result, err := doValidate(token)
+	result, err := doValidate(r.Context(), token)
 	if err != nil {
-		respondWithError(w, err, http.StatusUnauthorized)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, result)
-}
-
-func generalValidateHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		getValidateHandler(w, r)
-	default:
-		w.Header().Add("Allow", "GET")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+	httpx.RespondOK(w, result)
 }
 
 type putRefreshRequest struct {
@@ -312,57 +358,92 @@ type putRefreshRequest struct {
 }
 
 type putRefreshResponse struct {
-	AccessToken string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token"`
+}
+
+var errTokenReused = httpx.NewError(http.StatusUnauthorized, "token_reused",
+	"Refresh token has already been used, the session is revoked")
+
+// revokeReusedSession is called when a rotated refresh token is presented
+// again. Either the client or an attacker holds a stolen copy, so the whole
+// session is revoked.
+func revokeReusedSession(ctx context.Context, rtinfo dbclient.TokenInfo) error {
+	logging.Warn("Refresh token reused, revoking the session", logging.Fields{"username": rtinfo.Username})
+	err := db.RevokeSession(ctx, rtinfo.Username, rtinfo.SessionID, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		return err
+	}
+	return errTokenReused
 }
 
 func putRefreshHandler(w http.ResponseWriter, r *http.Request) {
 	var request putRefreshRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err := httpx.DecodeJSON(r, &request)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	rtinfo, err := db.GetTokenInfo(request.RefreshToken)
+	rtinfo, err := db.GetTokenInfo(r.Context(), request.RefreshToken)
 	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, errors.New("Token is not valid"), http.StatusForbidden)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
+		if err == dbclient.ErrNotFound {
+			err = auth.ErrInvalidToken
 		}
+		httpx.RespondError(w, r, err)
 		return
 	}
 	if rtinfo.Type != dbclient.REFRESH {
-		respondWithError(w, errors.New("Should provide refresh token"), http.StatusBadRequest)
+		httpx.RespondError(w, r, errWrongTokenType("refresh"))
 		return
 	}
 	if rtinfo.ExpTime.Before(time.Now()) {
-		respondWithError(w, errors.New("Token has expired"), http.StatusForbidden)
+		httpx.RespondError(w, r, auth.ErrTokenExpired)
 		return
 	}
-	access := generateToken(conf.TokenLength)
-	atinfo := dbclient.TokenInfo{
-		access,
-		time.Now().Add(conf.AccessTokenLifeTime),
-		dbclient.ACCESS,
-		rtinfo.Username,
+	if rtinfo.Used {
+		httpx.RespondError(w, r, revokeReusedSession(r.Context(), rtinfo))
+		return
 	}
-	err = db.AddNewToken(atinfo)
+	user, err := db.GetUser(r.Context(), rtinfo.Username)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, putRefreshResponse{access})
-}
-
-func generalRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "PUT":
-		putRefreshHandler(w, r)
-	default:
-		w.Header().Add("Allow", "PUT")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	next := dbclient.TokenInfo{
+		Token:     generateToken(conf.TokenLength),
+		ExpTime:   time.Now().Add(conf.RefreshTokenLifeTime),
+		Type:      dbclient.REFRESH,
+		Username:  rtinfo.Username,
+		SessionID: rtinfo.SessionID,
+	}
+	if len(next.SessionID) == 0 {
+		next.SessionID = generateToken(32)
+	}
+	err = db.RotateToken(r.Context(), rtinfo.Token, next, dbclient.Session{
+		ID:         next.SessionID,
+		Username:   next.Username,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  next.ExpTime,
+		UserAgent:  r.UserAgent(),
+		IP:         httpx.ClientIP(r),
+	})
+	if err == dbclient.ErrTokenUsed {
+		err = revokeReusedSession(r.Context(), rtinfo)
+	}
+	if err == dbclient.ErrNotFound {
+		err = auth.ErrTokenRevoked
 	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	access, err := issueAccessToken(r.Context(), user.Username, user.Permissions, next.SessionID)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, putRefreshResponse{next.Token, access})
 }
 
 type putSetPermissionsRequest struct {
@@ -373,31 +454,19 @@ type putSetPermissionsRequest struct {
 type putSetPermissionsResponse struct{}
 
 func putSetPermissionsHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "manage") {
-		return
-	}
 	var request putSetPermissionsRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err := httpx.DecodeJSON(r, &request)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	err = db.SetPermissions(request.Username, request.Permissions)
+	err = db.SetPermissions(r.Context(), request.Username, request.Permissions,
+		time.Now().Add(conf.AccessTokenLifeTime))
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, httpx.BadRequest(err))
 		return
 	}
-	respondOK(w, putSetPermissionsResponse{})
-}
-
-func generalSetPermissionsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "PUT":
-		putSetPermissionsHandler(w, r)
-	default:
-		w.Header().Add("Allow", "PUT")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+	httpx.RespondOK(w, putSetPermissionsResponse{})
 }
 
 type confirmResponse struct {
@@ -405,54 +474,109 @@ type confirmResponse struct {
 }
 
 func confirmHandler(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.URL.Path, "/confirm/")
-	tinfo, err := db.GetTokenInfo(token)
-	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, errors.New("Token is not valid"), http.StatusUnauthorized)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
+	tinfo, err := db.GetTokenInfo(r.Context(), httpx.Param(r, "token"))
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = auth.ErrInvalidToken
 		}
+		httpx.RespondError(w, r, err)
 		return
 	}
 	if tinfo.Type != dbclient.CONFIRM {
-		respondWithError(w, errors.New("Should provide confirm token"), http.StatusBadRequest)
+		httpx.RespondError(w, r, errWrongTokenType("confirm"))
 		return
 	}
 	if tinfo.ExpTime.Before(time.Now()) {
-		respondWithError(w, errors.New("Token has expired"), http.StatusUnauthorized)
+		httpx.RespondError(w, r, auth.ErrTokenExpired)
 		return
 	}
-	err = db.ConfirmPhoneNumber(tinfo.Username)
+	err = db.ConfirmPhoneNumber(r.Context(), tinfo.Username)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, confirmResponse{"Registration has been successfully confirmed"})
+	httpx.RespondOK(w, confirmResponse{"Registration has been successfully confirmed"})
 }
 
 func main() {
-	var err error
-	err = conf.Load()
+	config.MustLoad(&conf)
+	if conf.ConfirmMode == "link" && len(conf.ConfirmAddress) == 0 {
+		log.Panic("CONFIRM_ADDRESS is required in the link confirmation mode")
+	}
+	err := logging.Setup("authentication", conf.Log)
+	if err != nil {
+		log.Panic(err)
+	}
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("authentication", conf.Tracing)
+	if err != nil {
+		log.Panic(err)
+	}
+	db, err = dbclient.CreateDbClient(conf.Database)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = keys.rotate(context.Background())
+	if err != nil {
+		log.Panic(err)
+	}
+	go runKeyRotation(time.Minute)
+	limits = createLimitStore(conf.Limits)
+	go runJanitor(conf.CleanupInterval)
+	conf.MQ.Topology = []mq.Queue{mq.SmsMessages}
+	mqc, err := mq.CreateClient(conf.MQ)
+	if err != nil {
+		log.Panic(err)
+	}
+	sms, err = mqc.NewSmsPublisher()
 	if err != nil {
 		log.Panic(err)
 	}
-	db, err = dbclient.CreateDbClient()
+	proxies, err := httpx.TrustProxies(conf.Proxy)
 	if err != nil {
 		log.Panic(err)
 	}
-	mq, err = mqclient.CreateMqClient()
+	router := httpx.CreateRouter()
+	router.Use(httpx.CORS(conf.CORS), proxies)
+	router.Post("/signup", postSignUpHandler)
+	router.Post("/signin", postSignInHandler)
+	router.Get("/validate", getValidateHandler)
+	router.Put("/refresh", putRefreshHandler)
+	router.Put("/set_permissions", putSetPermissionsHandler, requirePermission("manage"))
+	router.Post("/logout", postLogoutHandler)
+	router.Post("/logout-all", postLogoutAllHandler)
+	router.Post("/revoke_sessions", postRevokeSessionsHandler, requirePermission("manage"))
+	router.Post("/password/forgot", postPasswordForgotHandler)
+	router.Post("/password/reset", postPasswordResetHandler)
+	router.Put("/me/password", putMePasswordHandler)
+	router.Put("/me/phone", putMePhoneHandler)
+	router.Post("/signin/2fa", postSignIn2FAHandler)
+	router.Post("/signin/2fa/sms", postSignIn2FASmsHandler)
+	router.Post("/me/2fa/setup", postMe2FASetupHandler)
+	router.Post("/me/2fa/verify", postMe2FAVerifyHandler)
+	router.Post("/me/2fa/disable", postMe2FADisableHandler)
+	router.Post("/me/2fa/recovery_codes", postMe2FARecoveryCodesHandler)
+	router.Get("/sessions", getSessionsHandler)
+	router.Delete("/sessions/{id}", deleteSessionHandler)
+	router.Get("/confirm/{token}", confirmHandler)
+	router.Post("/confirm", postConfirmHandler)
+	router.Get("/.well-known/jwks.json", getJWKSHandler)
+	http.Handle("/", router)
+	hc := health.CreateHealth()
+	hc.Add("database", db.Ping)
+	hc.AddPing("message queue", mqc.Ping)
+	hc.Register(http.DefaultServeMux)
+	http.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress})
+	RunRpcServer(sd, conf.RPCAddress)
+	sd.Add("password resets", waitResets)
+	sd.AddCloser("message queue", func() { mqc.Close() })
+	sd.AddCloser("database", db.Close)
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Auth-server started")
+	err = sd.Wait()
 	if err != nil {
 		log.Panic(err)
 	}
-	http.HandleFunc("/signup", generalSignUpHandler)
-	http.HandleFunc("/signin", generalSignInHandler)
-	http.HandleFunc("/validate", generalValidateHandler)
-	http.HandleFunc("/refresh", generalRefreshHandler)
-	http.HandleFunc("/set_permissions", generalSetPermissionsHandler)
-	http.HandleFunc("/confirm/", confirmHandler)
-	log.Println("Auth-server started")
-	go RunRpcServer()
-	log.Panic(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"common/httpx"
+)
+
+type putMePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type putMePasswordResponse struct{}
+
+// putMePasswordHandler changes the password of the user and signs out the
+// other sessions, the one making the request stays valid.
+func putMePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request putMePasswordRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	info, err := getAccessInfo(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := db.GetUser(r.Context(), info.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkPassword(w, r, user, request.CurrentPassword) {
+		return
+	}
+	if len(request.NewPassword) == 0 {
+		httpx.RespondError(w, r, errEmptyPassword)
+		return
+	}
+	hash, err := hashPassword(request.NewPassword)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.ChangePassword(r.Context(), user.Username, hash, info.SessionID, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, putMePasswordResponse{})
+}
+
+type putMePhoneRequest struct {
+	PhoneNumber string `json:"phone_number"`
+}
+
+type putMePhoneResponse struct {
+	Message string `json:"message"`
+}
+
+var errEmptyPhone = httpx.NewError(http.StatusBadRequest, "bad_request", "Phone number should not be empty")
+
+func putMePhoneHandler(w http.ResponseWriter, r *http.Request) {
+	var request putMePhoneRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if len(request.PhoneNumber) == 0 {
+		httpx.RespondError(w, r, errEmptyPhone)
+		return
+	}
+	if !checkResend(w, r, user.Username) {
+		return
+	}
+	err = db.ChangePhoneNumber(r.Context(), user.Username, request.PhoneNumber)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = sendConfirmationMessage(r.Context(), user.Username, request.PhoneNumber)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, putMePhoneResponse{"We sent the confirmation " + conf.ConfirmMode + " to your new phone."})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"authentication/dbclient"
+	"common/auth"
+	"common/httpx"
+	"common/logging"
+	"common/mq"
+	"common/tracing"
+)
+
+type postPasswordForgotRequest struct {
+	Username string `json:"username"`
+}
+
+type postPasswordForgotResponse struct {
+	Message string `json:"message"`
+}
+
+// postPasswordForgotHandler answers the same way whether the user exists or
+// not, so it can't be used to find out registered usernames.
+func postPasswordForgotHandler(w http.ResponseWriter, r *http.Request) {
+	var request postPasswordForgotRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	window := conf.PasswordResetWindow
+	if !checkLimit(w, r, "reset-ip:"+httpx.ClientIP(r), rateLimit{conf.PasswordResetIPLimit, window}) ||
+		!checkLimit(w, r, "reset-user:"+request.Username, rateLimit{conf.PasswordResetLimit, window}) {
+		return
+	}
+	user, err := db.GetUser(r.Context(), request.Username)
+	if err != nil && err != dbclient.ErrNotFound {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	switch {
+	case err == dbclient.ErrNotFound:
+		logging.Info("Password reset requested for unknown user", logging.Fields{"username": request.Username})
+	case !user.PhoneConfirmed:
+		logging.Info("Password reset requested for unconfirmed user", logging.Fields{"username": request.Username})
+	default:
+		ctx := logging.WithRequestID(tracing.Detach(r.Context()), logging.RequestID(r.Context()))
+		resets.Add(1)
+		go func() {
+			defer resets.Done()
+			sendResetCode(ctx, user)
+		}()
+	}
+	httpx.RespondOK(w, postPasswordForgotResponse{"If the user exists, we sent a password reset code to the phone number."})
+}
+
+// resets are the reset codes being sent after the response.
+var resets sync.WaitGroup
+
+// sendResetCode runs after the response, so the response time doesn't
+// depend on whether the user exists. Errors are only logged.
+func sendResetCode(ctx context.Context, user dbclient.User) {
+	token := generateToken(conf.TokenLength)
+	tinfo := dbclient.TokenInfo{
+		Token:    token,
+		ExpTime:  time.Now().Add(conf.ResetTokenLifeTime),
+		Type:     dbclient.RESET,
+		Username: user.Username,
+	}
+	err := db.AddNewToken(ctx, tinfo)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to create password reset code", logging.Fields{"error": err})
+		return
+	}
+	msg := fmt.Sprintf("Your password reset code: %s", token)
+	err = sms.Send(ctx, mq.SmsMessage{To: user.PhoneNumber, Message: msg})
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to send password reset code", logging.Fields{"error": err})
+	}
+}
+
+func waitResets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		resets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type postPasswordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type postPasswordResetResponse struct {
+	Message string `json:"message"`
+}
+
+var errEmptyPassword = httpx.NewError(http.StatusBadRequest, "bad_request", "Password should not be empty")
+
+func postPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var request postPasswordResetRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLimit(w, r, "reset-confirm-ip:"+httpx.ClientIP(r), rateLimit{conf.PasswordResetIPLimit, conf.PasswordResetWindow}) {
+		return
+	}
+	if len(request.Password) == 0 {
+		httpx.RespondError(w, r, errEmptyPassword)
+		return
+	}
+	// The code is checked before hashing, so wrong codes don't cost a bcrypt
+	// run. ResetPassword checks it again when consuming it.
+	tinfo, err := db.GetTokenInfo(r.Context(), request.Token)
+	if err == nil && (tinfo.Type != dbclient.RESET || tinfo.ExpTime.Before(time.Now())) {
+		err = dbclient.ErrNotFound
+	}
+	if err == nil {
+		_, err = db.GetUser(r.Context(), tinfo.Username)
+	}
+	if err == dbclient.ErrNotFound {
+		err = auth.ErrInvalidToken
+	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	hash, err := hashPassword(request.Password)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.ResetPassword(r.Context(), request.Token, hash, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = auth.ErrInvalidToken
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postPasswordResetResponse{"Password has been changed, sign in with the new password."})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"authentication/dbclient"
+	"common/httpx"
+)
+
+var errTooManyRequests = httpx.NewError(http.StatusTooManyRequests, "too_many_requests",
+	"Too many requests, try again later")
+var errAccountLocked = httpx.NewError(http.StatusTooManyRequests, "account_locked",
+	"Too many failed sign in attempts, try again later")
+
+// maxWindow bounds the windows of all limits, counters older than that are
+// deleted.
+const maxWindow = 24 * time.Hour
+
+type LimitsConfig struct {
+	// The memory store keeps counters per instance, the postgres one shares
+	// them between replicas.
+	Store        string        `env:"RATE_LIMIT_STORE" default:"memory" oneof:"memory,postgres"`
+	Window       time.Duration `env:"RATE_LIMIT_WINDOW" default:"1m" min:"1s" max:"24h"`
+	SignInIP     uint          `env:"SIGNIN_IP_LIMIT" default:"30" min:"1"`
+	SignInUser   uint          `env:"SIGNIN_USER_LIMIT" default:"10" min:"1"`
+	SignUpIP     uint          `env:"SIGNUP_IP_LIMIT" default:"5" min:"1"`
+	ConfirmIP    uint          `env:"CONFIRM_IP_LIMIT" default:"30" min:"1"`
+	TOTPVerify   uint          `env:"TWO_FACTOR_VERIFY_LIMIT" default:"5" min:"1"`
+	ResendPeriod time.Duration `env:"CONFIRM_RESEND_COOLDOWN" default:"1m" min:"1s" max:"24h"`
+
+	LockoutThreshold   uint          `env:"LOGIN_LOCKOUT_THRESHOLD" default:"5" min:"1"`
+	LockoutDuration    time.Duration `env:"LOGIN_LOCKOUT_DURATION" default:"1m" min:"1s"`
+	LockoutMaxDuration time.Duration `env:"LOGIN_LOCKOUT_MAX_DURATION" default:"1h" min:"1s" max:"24h"`
+}
+
+type rateLimit struct {
+	Limit  uint
+	Window time.Duration
+}
+
+// limitStore keeps request counters in fixed windows.
+type limitStore interface {
+	hit(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error)
+	get(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error)
+	reset(ctx context.Context, key string) error
+	prune(ctx context.Context) error
+}
+
+type memoryStore struct {
+	mutex    sync.Mutex
+	counters map[string]*dbclient.RateCounter
+}
+
+func (s *memoryStore) hit(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	c, ok := s.counters[key]
+	if !ok || now.Sub(c.Start) >= window {
+		c = &dbclient.RateCounter{Start: now}
+		s.counters[key] = c
+	}
+	c.Count++
+	c.Last = now
+	return *c, nil
+}
+
+func (s *memoryStore) get(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, ok := s.counters[key]
+	if !ok || time.Since(c.Start) >= window {
+		return dbclient.RateCounter{}, nil
+	}
+	return *c, nil
+}
+
+func (s *memoryStore) reset(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.counters, key)
+	return nil
+}
+
+func (s *memoryStore) prune(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, c := range s.counters {
+		if time.Since(c.Start) > maxWindow {
+			delete(s.counters, key)
+		}
+	}
+	return nil
+}
+
+type postgresStore struct{}
+
+func (postgresStore) hit(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error) {
+	return db.HitRateLimit(ctx, key, window)
+}
+
+func (postgresStore) get(ctx context.Context, key string, window time.Duration) (dbclient.RateCounter, error) {
+	return db.GetRateLimit(ctx, key, window)
+}
+
+func (postgresStore) reset(ctx context.Context, key string) error {
+	return db.ResetRateLimit(ctx, key)
+}
+
+func (postgresStore) prune(ctx context.Context) error {
+	_, err := db.DeleteRateLimits(ctx, time.Now().Add(-maxWindow))
+	return err
+}
+
+func createLimitStore(conf LimitsConfig) limitStore {
+	if conf.Store == "postgres" {
+		return postgresStore{}
+	}
+	return &memoryStore{counters: make(map[string]*dbclient.RateCounter)}
+}
+
+var limits limitStore
+
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+}
+
+// checkLimit counts the request and responds with 429 when the limit of the
+// key is exceeded. It returns false if a response has been written.
+func checkLimit(w http.ResponseWriter, r *http.Request, key string, limit rateLimit) bool {
+	c, err := limits.hit(r.Context(), key, limit.Window)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return false
+	}
+	if c.Count > limit.Limit {
+		retryAfter(w, time.Until(c.Start.Add(limit.Window)))
+		httpx.RespondError(w, r, errTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func resendKey(username string) string {
+	return "confirm-resend:" + username
+}
+
+// checkResend responds with 429 if a confirmation has been sent to the user
+// within CONFIRM_RESEND_COOLDOWN. It doesn't count the request.
+func checkResend(w http.ResponseWriter, r *http.Request, username string) bool {
+	c, err := limits.get(r.Context(), resendKey(username), conf.Limits.ResendPeriod)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return false
+	}
+	if c.Count != 0 {
+		retryAfter(w, time.Until(c.Start.Add(conf.Limits.ResendPeriod)))
+		httpx.RespondError(w, r, errResendCooldown)
+		return false
+	}
+	return true
+}
+
+func failuresKey(username string) string {
+	return "signin-failures:" + username
+}
+
+// lockedFor tells how long sign in is locked after failed attempts. The lock
+// starts after LockoutThreshold failures and doubles with each next one.
+func lockedFor(ctx context.Context, username string) (time.Duration, error) {
+	c, err := limits.get(ctx, failuresKey(username), maxWindow)
+	if err != nil || c.Count < conf.Limits.LockoutThreshold {
+		return 0, err
+	}
+	lock := conf.Limits.LockoutDuration
+	for i := conf.Limits.LockoutThreshold; i < c.Count && lock < conf.Limits.LockoutMaxDuration; i++ {
+		lock *= 2
+	}
+	if lock > conf.Limits.LockoutMaxDuration {
+		lock = conf.Limits.LockoutMaxDuration
+	}
+	return time.Until(c.Last.Add(lock)), nil
+}
+
+// checkLockout responds with 429 while sign in of the user is locked.
+func checkLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait, err := lockedFor(r.Context(), username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		retryAfter(w, wait)
+		httpx.RespondError(w, r, errAccountLocked)
+		return false
+	}
+	return true
+}
+
+func signInFailed(ctx context.Context, username string) error {
+	_, err := limits.hit(ctx, failuresKey(username), maxWindow)
+	return err
+}
+
+// checkPassword checks the current password of a signed in user. Wrong
+// passwords count as failed sign ins, so a stolen session can't be used to
+// guess the password past the lockout.
+func checkPassword(w http.ResponseWriter, r *http.Request, user dbclient.User, password string) bool {
+	if !checkLockout(w, r, user.Username) {
+		return false
+	}
+	if checkPasswordHash(password, user.PassHash) {
+		return true
+	}
+	err := signInFailed(r.Context(), user.Username)
+	if err == nil {
+		err = ErrNotValid
+	}
+	httpx.RespondError(w, r, err)
+	return false
+}
+
+// codeFailed counts a wrong second factor code as a failed sign in, so the
+// lockout also limits guessing codes. Other errors are returned as is.
+func codeFailed(ctx context.Context, username string, err error) error {
+	if err != errCodeNotValid {
+		return err
+	}
+	failErr := signInFailed(ctx, username)
+	if failErr != nil {
+		return failErr
+	}
+	return err
+}
+
+func signInSucceeded(ctx context.Context, username string) error {
+	return limits.reset(ctx, failuresKey(username))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"authentication/dbclient"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testStores returns the stores to test. The postgres one needs a database
+// in TEST_DATABASE_URL, its tables are created if missing.
+func testStores(t *testing.T) map[string]limitStore {
+	stores := map[string]limitStore{"memory": createLimitStore(LimitsConfig{Store: "memory"})}
+	if !connectTestDB(t) {
+		t.Log("TEST_DATABASE_URL is not set, skipping the postgres store")
+		return stores
+	}
+	stores["postgres"] = postgresStore{}
+	return stores
+}
+
+// useLimits replaces the global store and limits for a test.
+func useLimits(store limitStore, l LimitsConfig) func() {
+	savedStore, savedConf := limits, conf
+	limits = store
+	conf.Limits = l
+	return func() {
+		limits, conf = savedStore, savedConf
+	}
+}
+
+func TestLimitStores(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		key := "test-" + name + "-" + generateToken(8)
+		for i := uint(1); i <= 3; i++ {
+			c, err := store.hit(ctx, key, time.Hour)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if c.Count != i {
+				t.Errorf("%s: hit %d counted %d", name, i, c.Count)
+			}
+		}
+		c, err := store.get(ctx, key, time.Hour)
+		if err != nil || c.Count != 3 {
+			t.Errorf("%s: got count %d (%v), want 3", name, c.Count, err)
+		}
+		c, err = store.get(ctx, key, time.Hour)
+		if err != nil || c.Count != 3 {
+			t.Errorf("%s: get counted the request, got %d (%v)", name, c.Count, err)
+		}
+		err = store.reset(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c, err = store.get(ctx, key, time.Hour)
+		if err != nil || c.Count != 0 {
+			t.Errorf("%s: got count %d (%v) after reset", name, c.Count, err)
+		}
+
+		// A new window starts with a new count.
+		window := 200 * time.Millisecond
+		store.hit(ctx, key, window)
+		first, _ := store.hit(ctx, key, window)
+		time.Sleep(window + 50*time.Millisecond)
+		c, err = store.get(ctx, key, window)
+		if err != nil || c.Count != 0 {
+			t.Errorf("%s: got count %d (%v) of a passed window", name, c.Count, err)
+		}
+		c, err = store.hit(ctx, key, window)
+		if err != nil || c.Count != 1 || !c.Start.After(first.Start) {
+			t.Errorf("%s: got count %d from %v (%v) in a new window, want 1 after %v", name, c.Count, c.Start, err, first.Start)
+		}
+		store.reset(ctx, key)
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	store := createLimitStore(LimitsConfig{Store: "memory"}).(*memoryStore)
+	store.counters["old"] = &dbclient.RateCounter{Count: 1, Start: time.Now().Add(-maxWindow - time.Second)}
+	store.counters["new"] = &dbclient.RateCounter{Count: 1, Start: time.Now()}
+	store.prune(context.Background())
+	if _, ok := store.counters["old"]; ok {
+		t.Error("Kept an old counter")
+	}
+	if _, ok := store.counters["new"]; !ok {
+		t.Error("Deleted a current counter")
+	}
+}
+
+func TestCheckLimit(t *testing.T) {
+	defer useLimits(createLimitStore(LimitsConfig{Store: "memory"}), LimitsConfig{})()
+	limit := rateLimit{2, time.Minute}
+	for i := 1; i <= 4; i++ {
+		w := httptest.NewRecorder()
+		ok := checkLimit(w, httptest.NewRequest("POST", "/signin", nil), "key", limit)
+		if want := i <= 2; ok != want {
+			t.Fatalf("Request %d passed: %v, want %v", i, ok, want)
+		}
+		if ok {
+			continue
+		}
+		if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "too_many_requests") {
+			t.Errorf("Request %d got %d %s", i, w.Code, w.Body.String())
+		}
+		if retry := w.Header().Get("Retry-After"); retry != "60" {
+			t.Errorf("Request %d got Retry-After %q, want 60", i, retry)
+		}
+	}
+	// Other keys have their own counters.
+	if !checkLimit(httptest.NewRecorder(), httptest.NewRequest("POST", "/signin", nil), "other", limit) {
+		t.Error("Limited another key")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := LimitsConfig{LockoutThreshold: 3, LockoutDuration: time.Minute, LockoutMaxDuration: 4 * time.Minute}
+	tests := []struct {
+		failures int
+		lock     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{8, 4 * time.Minute},
+	}
+	for name, store := range testStores(t) {
+		restore := useLimits(store, l)
+		ctx := context.Background()
+		for _, test := range tests {
+			username := "lockout-" + generateToken(8)
+			for i := 0; i < test.failures; i++ {
+				err := signInFailed(ctx, username)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}
+			wait, err := lockedFor(ctx, username)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if wait > test.lock || wait < test.lock-time.Second {
+				t.Errorf("%s: %d failures lock for %v, want %v", name, test.failures, wait, test.lock)
+			}
+			w := httptest.NewRecorder()
+			ok := checkLockout(w, httptest.NewRequest("POST", "/signin", nil), username)
+			if ok != (test.lock == 0) {
+				t.Errorf("%s: %d failures passed the lockout: %v", name, test.failures, ok)
+			}
+			if !ok && (w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "account_locked")) {
+				t.Errorf("%s: %d failures got %d %s", name, test.failures, w.Code, w.Body.String())
+			}
+			err = signInSucceeded(ctx, username)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			wait, _ = lockedFor(ctx, username)
+			if wait != 0 {
+				t.Errorf("%s: still locked for %v after a successful sign in", name, wait)
+			}
+		}
+		restore()
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	hash, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dummyCost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dummyCost != cost {
+		t.Errorf("Dummy hash has cost %d, passwords are hashed with %d", dummyCost, cost)
+	}
+	if checkPasswordHash("password", dummyPasswordHash) {
+		t.Error("Dummy hash matches a password")
+	}
+}
+
+// TestSignInUnknownUser needs a database: an unknown user is answered like
+// a wrong password and is locked out the same way.
+func TestSignInUnknownUser(t *testing.T) {
+	stores := testStores(t)
+	if _, ok := stores["postgres"]; !ok {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	defer useLimits(stores["memory"], LimitsConfig{
+		Window: time.Minute, SignInIP: 100, SignInUser: 100,
+		LockoutThreshold: 2, LockoutDuration: time.Minute, LockoutMaxDuration: time.Minute,
+	})()
+	username := "unknown-" + generateToken(8)
+	for i, want := range []string{"invalid_credentials", "invalid_credentials", "account_locked"} {
+		w := httptest.NewRecorder()
+		body := `{"username": "` + username + `", "password": "password"}`
+		start := time.Now()
+		postSignInHandler(w, httptest.NewRequest("POST", "/signin", strings.NewReader(body)))
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Attempt %d got %d %s, want %s", i+1, w.Code, w.Body.String(), want)
+		}
+		// The dummy hash costs as much as a real one.
+		if want == "invalid_credentials" && time.Since(start) < 100*time.Millisecond {
+			t.Errorf("Attempt %d took only %v", i+1, time.Since(start))
+		}
+	}
+}
@@ -1,34 +1,77 @@
 package main
 
 import (
+	"authentication/dbclient"
+	"common/auth"
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
 	pbauth "common/proto"
+	"common/shutdown"
+	"common/tracing"
 	"context"
 	"log"
 	"net"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
-func RunRpcServer() {
-	listener, err := net.Listen("tcp", ":5300")
+func RunRpcServer(sd *shutdown.Shutdown, address string) {
+	listener, err := net.Listen("tcp", address)
 
 	if err != nil {
-		log.Panic("failed to listen: %v", err)
+		log.Panicf("failed to listen: %v", err)
 	}
 
-	opts := []grpc.ServerOption{}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			tracing.UnaryServerInterceptor(),
+			logging.UnaryServerInterceptor,
+			metrics.UnaryServerInterceptor),
+	}
 	grpcServer := grpc.NewServer(opts...)
 
 	pbauth.RegisterAuthRpcServer(grpcServer, &AuthRpcServer{})
-	log.Println("AuthRpc service started")
-	grpcServer.Serve(listener)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(auth.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go func() {
+		err := grpcServer.Serve(listener)
+		if err != nil {
+			sd.Fail(err)
+		}
+	}()
+	sd.Add("rpc server", func(ctx context.Context) error {
+		healthServer.Shutdown()
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			return ctx.Err()
+		}
+	})
+	logging.Info("AuthRpc service started")
 }
 
 type AuthRpcServer struct{}
 
 func (s *AuthRpcServer) Validate(c context.Context, request *pbauth.ValidateRequest) (response *pbauth.ValidateResponse, err error) {
-	result, err := doValidate(request.AccessToken)
+	result, err := doValidate(c, request.AccessToken)
 	if err != nil {
+		if _, ok := err.(*httpx.Error); ok {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
 		return nil, err
 	}
 	response = &pbauth.ValidateResponse{
@@ -37,3 +80,36 @@ func (s *AuthRpcServer) Validate(c context.Context, request *pbauth.ValidateRequ
 	}
 	return response, nil
 }
+
+// revocationSettle is how long a revocation may stay invisible to readers:
+// rows with smaller ids can be committed after rows with larger ones, so the
+// last id reported to clients covers only the revocations older than that.
+const revocationSettle = 10 * time.Second
+
+func (s *AuthRpcServer) GetRevocations(c context.Context, request *pbauth.GetRevocationsRequest) (*pbauth.GetRevocationsResponse, error) {
+	revocations, err := db.GetRevocations(c, request.AfterId)
+	if err != nil {
+		return nil, err
+	}
+	return revocationsResponse(request.AfterId, revocations, time.Now()), nil
+}
+
+func revocationsResponse(afterID int64, revocations []dbclient.Revocation, now time.Time) *pbauth.GetRevocationsResponse {
+	response := &pbauth.GetRevocationsResponse{LastId: afterID}
+	settled := true
+	for _, r := range revocations {
+		response.Revocations = append(response.Revocations, &pbauth.Revocation{
+			Id:          r.ID,
+			Username:    r.Username,
+			TokenId:     r.TokenID,
+			RevokedAt:   r.RevokedAt.Unix(),
+			ExpiresAt:   r.ExpiresAt.Unix(),
+			RevokedAtMs: auth.UnixMs(r.RevokedAt),
+		})
+		settled = settled && now.Sub(r.RevokedAt) > revocationSettle
+		if settled {
+			response.LastId = r.ID
+		}
+	}
+	return response
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"authentication/dbclient"
+)
+
+func TestRevocationsResponse(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Minute)
+	fresh := now.Add(-time.Second)
+	tests := []struct {
+		name     string
+		revoked  []time.Time
+		wantLast int64
+	}{
+		{"nothing new", nil, 5},
+		{"all settled", []time.Time{old, old}, 7},
+		{"fresh last", []time.Time{old, fresh}, 6},
+		{"fresh first", []time.Time{fresh, old}, 5},
+		{"settled after fresh", []time.Time{old, fresh, old}, 6},
+	}
+	for _, test := range tests {
+		var revocations []dbclient.Revocation
+		for i, revokedAt := range test.revoked {
+			revocations = append(revocations, dbclient.Revocation{
+				ID:        int64(6 + i),
+				Username:  "user",
+				RevokedAt: revokedAt,
+				ExpiresAt: now.Add(time.Hour),
+			})
+		}
+		response := revocationsResponse(5, revocations, now)
+		if response.LastId != test.wantLast {
+			t.Errorf("%s: got last id %d, want %d", test.name, response.LastId, test.wantLast)
+		}
+		// Unsettled revocations are still applied by the clients, they are
+		// just sent again with the next request.
+		if len(response.Revocations) != len(revocations) {
+			t.Errorf("%s: got %d revocations, want %d", test.name, len(response.Revocations), len(revocations))
+		}
+	}
+}
+
+func TestRevocationsResponseKeepsMilliseconds(t *testing.T) {
+	revokedAt := time.Unix(1600000000, 123456789)
+	response := revocationsResponse(0, []dbclient.Revocation{{ID: 1, RevokedAt: revokedAt}}, revokedAt)
+	r := response.Revocations[0]
+	if r.RevokedAt != 1600000000 || r.RevokedAtMs != 1600000000123 {
+		t.Errorf("Got revoked_at %d and revoked_at_ms %d", r.RevokedAt, r.RevokedAtMs)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"authentication/dbclient"
+	"common/httpx"
+)
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+type getSessionsResponse struct {
+	Sessions []sessionResponse `json:"sessions"`
+}
+
+func getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := getAccessInfo(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	sessions, err := db.GetSessions(r.Context(), info.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	response := getSessionsResponse{Sessions: []sessionResponse{}}
+	for _, s := range sessions {
+		response.Sessions = append(response.Sessions, sessionResponse{
+			ID:         s.ID,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			Current:    s.ID == info.SessionID,
+		})
+	}
+	httpx.RespondOK(w, response)
+}
+
+type deleteSessionResponse struct{}
+
+var errSessionNotFound = httpx.NewError(http.StatusNotFound, "not_found", "Session not found")
+
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := getAccessInfo(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	session, err := db.GetSession(r.Context(), httpx.Param(r, "id"))
+	if err == dbclient.ErrNotFound || err == nil && session.Username != info.Username {
+		err = errSessionNotFound
+	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.RevokeSession(r.Context(), session.Username, session.ID, time.Now().Add(conf.AccessTokenLifeTime))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, deleteSessionResponse{})
+}
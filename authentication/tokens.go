@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"authentication/dbclient"
+	"common/auth"
+)
+
+// issueAccessToken creates an access token in the configured format. Opaque
+// tokens are stored in the database, JWT ones carry the permissions and are
+// only recorded when revoked.
+func issueAccessToken(ctx context.Context, username string, permissions []string, sessionID string) (string, error) {
+	if conf.AccessTokenFormat == "jwt" {
+		claims := auth.NewClaims(username, permissions, generateToken(32), sessionID, conf.AccessTokenLifeTime)
+		return auth.SignToken(keys.signer(), claims)
+	}
+	access := generateToken(conf.TokenLength)
+	atinfo := dbclient.TokenInfo{
+		Token:     access,
+		ExpTime:   time.Now().Add(conf.AccessTokenLifeTime),
+		Type:      dbclient.ACCESS,
+		Username:  username,
+		SessionID: sessionID,
+	}
+	return access, db.AddNewToken(ctx, atinfo)
+}
+
+func parseJWT(ctx context.Context, token string) (auth.Claims, error) {
+	claims, err := auth.ParseToken(token, keys.publicKey)
+	if err == auth.ErrUnknownKey {
+		// The key may have been created by another instance.
+		err = keys.load(ctx)
+		if err != nil {
+			return auth.Claims{}, err
+		}
+		claims, err = auth.ParseToken(token, keys.publicKey)
+	}
+	if err == auth.ErrUnknownKey {
+		return auth.Claims{}, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	revoked, err := db.IsRevoked(ctx, claims.Subject, []string{claims.ID, claims.SessionID}, claims.Issued())
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if revoked {
+		return auth.Claims{}, auth.ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+func validateJWT(ctx context.Context, token string) (getValidateResponse, error) {
+	claims, err := parseJWT(ctx, token)
+	if err != nil {
+		return getValidateResponse{}, err
+	}
+	return getValidateResponse{claims.Subject, claims.Permissions}, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, appendix B, cut to 6 digits.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(key, test.time/totpPeriod); code != test.code {
+			t.Errorf("At %d got %s, want %s", test.time, code, test.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1600000000, 0)
+	current := now.Unix() / totpPeriod
+	tests := []struct {
+		step int64
+		ok   bool
+	}{
+		{current - 2, false},
+		{current - 1, true},
+		{current, true},
+		{current + 1, true},
+		{current + 2, false},
+	}
+	for _, test := range tests {
+		step, ok := matchTOTP(secret, totpCode(key, test.step), now)
+		if ok != test.ok {
+			t.Errorf("Code of step %+d matched: %v, want %v", test.step-current, ok, test.ok)
+		}
+		if ok && step != test.step {
+			t.Errorf("Code of step %+d matched step %+d", test.step-current, step-current)
+		}
+	}
+	if _, ok := matchTOTP(secret, "", now); ok {
+		t.Error("Matched an empty code")
+	}
+	if _, ok := matchTOTP("not base32!", totpCode(key, current), now); ok {
+		t.Error("Matched with a malformed secret")
+	}
+}
+
+// TestTOTPReplay needs a database: a code is accepted once, and so is a code
+// of an earlier step after a later one has been used.
+func TestTOTPReplay(t *testing.T) {
+	if !connectTestDB(t) {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	username := "totp-" + generateToken(8)
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetupTOTP(ctx, username, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DisableTOTP(ctx, username)
+	totp, err := db.GetTOTP(ctx, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	current := time.Now().Unix() / totpPeriod
+	tests := []struct {
+		name string
+		step int64
+		err  error
+	}{
+		{"current", current, nil},
+		{"replayed", current, errCodeNotValid},
+		{"earlier", current - 1, errCodeNotValid},
+		{"next", current + 1, nil},
+		{"next replayed", current + 1, errCodeNotValid},
+	}
+	for _, test := range tests {
+		err := checkTOTP(ctx, username, totp, totpCode(key, test.step))
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// TestRecoveryCodes needs a database: each code works once and regenerating
+// the codes invalidates the old ones.
+func TestRecoveryCodes(t *testing.T) {
+	if !connectTestDB(t) {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	username := "recovery-" + generateToken(8)
+	codes := generateRecoveryCodes()
+	err := db.SetRecoveryCodes(ctx, username, codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DisableTOTP(ctx, username)
+	tests := []struct {
+		name string
+		code string
+		err  error
+	}{
+		{"first", codes[0], nil},
+		{"reused", codes[0], errCodeNotValid},
+		{"second", codes[1], nil},
+		{"unknown", "0123456789", errCodeNotValid},
+	}
+	for _, test := range tests {
+		err := checkSecondFactor(ctx, username, "recovery", test.code)
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+	err = db.SetRecoveryCodes(ctx, username, generateRecoveryCodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSecondFactor(ctx, username, "recovery", codes[2]); err != errCodeNotValid {
+		t.Errorf("Old code after regeneration: got %v, want %v", err, errCodeNotValid)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes := generateRecoveryCodes()
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 10 || seen[code] {
+			t.Errorf("Bad or repeated code %q", code)
+		}
+		seen[code] = true
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"authentication/dbclient"
+	"common/httpx"
+	"common/mq"
+)
+
+const recoveryCodeCount = 10
+
+var errChallengeNotValid = httpx.NewError(http.StatusUnauthorized, "invalid_challenge",
+	"Sign in challenge is not valid or has expired, sign in again")
+var errSmsCodeSent = httpx.NewError(http.StatusConflict, "conflict",
+	"The code has already been sent, sign in again to get a new one")
+var err2FAEnabled = httpx.NewError(http.StatusConflict, "2fa_enabled", dbclient.ErrTOTPEnabled.Error())
+var err2FANotEnabled = httpx.NewError(http.StatusConflict, "2fa_not_enabled",
+	"Two-factor authentication is not enabled")
+var err2FANotSetUp = httpx.NewError(http.StatusConflict, "2fa_not_set_up",
+	"Set up two-factor authentication first")
+
+func errUnknownMethod(method string) error {
+	return httpx.NewError(http.StatusBadRequest, "bad_request", "Unknown method '"+method+"'")
+}
+
+func startChallenge(ctx context.Context, username string) (string, error) {
+	token := generateToken(conf.TokenLength)
+	err := db.AddChallenge(ctx, dbclient.Challenge{
+		Token:        token,
+		Username:     username,
+		ExpiresAt:    time.Now().Add(conf.ChallengeLifeTime),
+		AttemptsLeft: conf.ChallengeAttempts,
+	})
+	return token, err
+}
+
+func generateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = generateToken(10)
+	}
+	return codes
+}
+
+// checkTOTP accepts each code once, so a code seen by someone else can't be
+// used again.
+func checkTOTP(ctx context.Context, username string, totp dbclient.TOTP, code string) error {
+	step, ok := matchTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return errCodeNotValid
+	}
+	fresh, err := db.UseTOTPStep(ctx, username, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errCodeNotValid
+	}
+	return nil
+}
+
+// checkSecondFactor checks a TOTP or a recovery code of the user with enabled
+// two-factor authentication.
+func checkSecondFactor(ctx context.Context, username string, method string, code string) error {
+	switch method {
+	case "totp":
+		totp, err := db.GetTOTP(ctx, username)
+		if err == dbclient.ErrNotFound || err == nil && !totp.Enabled {
+			return err2FANotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		return checkTOTP(ctx, username, totp, code)
+	case "recovery":
+		ok, err := db.UseRecoveryCode(ctx, username, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errCodeNotValid
+		}
+		return nil
+	}
+	return errUnknownMethod(method)
+}
+
+type postSignIn2FARequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Method         string `json:"method"`
+	Code           string `json:"code"`
+}
+
+// postSignIn2FAHandler completes the sign in with a TOTP, SMS or recovery
+// code. Each try uses an attempt of the challenge.
+func postSignIn2FAHandler(w http.ResponseWriter, r *http.Request) {
+	var request postSignIn2FARequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	challenge, err := db.TakeChallengeAttempt(r.Context(), request.ChallengeToken)
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = errChallengeNotValid
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLockout(w, r, challenge.Username) {
+		return
+	}
+	if request.Method == "sms" {
+		if !dbclient.CheckSMSCode(challenge, request.Code) {
+			err = errCodeNotValid
+		}
+	} else {
+		err = checkSecondFactor(r.Context(), challenge.Username, request.Method, request.Code)
+	}
+	err = codeFailed(r.Context(), challenge.Username, err)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.DeleteChallenge(r.Context(), request.ChallengeToken)
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = errChallengeNotValid
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = signInSucceeded(r.Context(), challenge.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := db.GetUser(r.Context(), challenge.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	response, err := startSession(r, user)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, response)
+}
+
+type postSignIn2FASmsRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+}
+
+type postSignIn2FASmsResponse struct {
+	Message string `json:"message"`
+}
+
+// postSignIn2FASmsHandler sends a sign in code by SMS, once per challenge.
+func postSignIn2FASmsHandler(w http.ResponseWriter, r *http.Request) {
+	var request postSignIn2FASmsRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	challenge, err := db.GetChallenge(r.Context(), request.ChallengeToken)
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = errChallengeNotValid
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if len(challenge.SMSCodeHash) != 0 {
+		httpx.RespondError(w, r, errSmsCodeSent)
+		return
+	}
+	user, err := db.GetUser(r.Context(), challenge.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	code, err := generateCode()
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.SetChallengeSMSCode(r.Context(), request.ChallengeToken, challenge.Username, code)
+	if err != nil {
+		if err == dbclient.ErrNotFound {
+			err = errSmsCodeSent
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	msg := fmt.Sprintf("Your sign in code: %s", code)
+	err = sms.Send(r.Context(), mq.SmsMessage{To: user.PhoneNumber, Message: msg})
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postSignIn2FASmsResponse{"We sent the sign in code to your phone."})
+}
+
+type postMe2FASetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// postMe2FASetupHandler creates a secret for an authenticator app. It takes
+// effect after the first code is verified.
+func postMe2FASetupHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.SetupTOTP(r.Context(), user.Username, secret)
+	if err != nil {
+		if err == dbclient.ErrTOTPEnabled {
+			err = err2FAEnabled
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postMe2FASetupResponse{secret, totpURI(conf.TOTPIssuer, user.Username, secret)})
+}
+
+type postMe2FAVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func postMe2FAVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var request postMe2FAVerifyRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLimit(w, r, "2fa-verify:"+user.Username, rateLimit{conf.Limits.TOTPVerify, conf.Limits.Window}) {
+		return
+	}
+	totp, err := db.GetTOTP(r.Context(), user.Username)
+	if err == dbclient.ErrNotFound {
+		err = err2FANotSetUp
+	} else if err == nil && totp.Enabled {
+		err = err2FAEnabled
+	}
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = checkTOTP(r.Context(), user.Username, totp, request.Code)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	codes := generateRecoveryCodes()
+	err = db.EnableTOTP(r.Context(), user.Username, codes)
+	if err != nil {
+		if err == dbclient.ErrTOTPEnabled {
+			err = err2FAEnabled
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, recoveryCodesResponse{codes})
+}
+
+type postMe2FADisableRequest struct {
+	Password string `json:"password"`
+	Method   string `json:"method"`
+	Code     string `json:"code"`
+}
+
+type postMe2FADisableResponse struct{}
+
+func postMe2FADisableHandler(w http.ResponseWriter, r *http.Request) {
+	var request postMe2FADisableRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	info, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := db.GetUser(r.Context(), info.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkPassword(w, r, user, request.Password) {
+		return
+	}
+	err = checkSecondFactor(r.Context(), user.Username, request.Method, request.Code)
+	err = codeFailed(r.Context(), user.Username, err)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	err = db.DisableTOTP(r.Context(), user.Username)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, postMe2FADisableResponse{})
+}
+
+type postMe2FARecoveryCodesRequest struct {
+	Code string `json:"code"`
+}
+
+// postMe2FARecoveryCodesHandler replaces the recovery codes, the old ones
+// stop working.
+func postMe2FARecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var request postMe2FARecoveryCodesRequest
+	err := httpx.DecodeJSON(r, &request)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	user, err := doValidate(r.Context(), r.Header.Get("auth"))
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if !checkLockout(w, r, user.Username) {
+		return
+	}
+	err = checkSecondFactor(r.Context(), user.Username, "totp", request.Code)
+	err = codeFailed(r.Context(), user.Username, err)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	codes := generateRecoveryCodes()
+	err = db.SetRecoveryCodes(r.Context(), user.Username, codes)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	httpx.RespondOK(w, recoveryCodesResponse{codes})
+}
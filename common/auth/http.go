@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"common/httpx"
+)
+
+type userKey struct{}
+
+// Require lets the request through only when the access token from the auth
+// header has the permission. The user is put into the request context.
+func (c *AuthClient) Require(permission string) httpx.Middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			perms, err := c.Validate(r.Context(), r.Header.Get("auth"))
+			if err != nil {
+				httpx.RespondError(w, r, err)
+				return
+			}
+			if !perms.Has(permission) {
+				httpx.RespondError(w, r, ErrForbidden)
+				return
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, perms)))
+		}
+	}
+}
+
+// User returns the user authorized by Require.
+func User(ctx context.Context) UserPermissions {
+	perms, _ := ctx.Value(userKey{}).(UserPermissions)
+	return perms
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"common/httpx"
+)
+
+// Access tokens in the JWT format are signed with Ed25519 (alg EdDSA), the
+// keys are published as a JWKS by the authentication service.
+
+var ErrInvalidToken = httpx.NewError(http.StatusUnauthorized, "invalid_token", "Token is not valid")
+var ErrTokenExpired = httpx.NewError(http.StatusUnauthorized, "token_expired", "Token has expired")
+var ErrTokenRevoked = httpx.NewError(http.StatusUnauthorized, "token_revoked", "Token has been revoked")
+
+// ErrUnknownKey means the token is signed with a key missing from the key
+// set, which may be a key published after the set was fetched.
+var ErrUnknownKey = errors.New("Token is signed with an unknown key")
+
+const tokenIssuer = "authentication"
+
+type Claims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	Permissions []string `json:"perms"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	ID          string   `json:"jti"`
+	SessionID   string   `json:"sid,omitempty"`
+	// IssuedAtMs is the issue time in milliseconds. iat has whole seconds,
+	// which can't tell a token issued right after a revocation from the
+	// tokens it revokes.
+	IssuedAtMs int64 `json:"iat_ms,omitempty"`
+}
+
+func NewClaims(username string, permissions []string, id string, sessionID string, lifeTime time.Duration) Claims {
+	now := time.Now()
+	return Claims{tokenIssuer, username, permissions, now.Unix(), now.Add(lifeTime).Unix(), id, sessionID, UnixMs(now)}
+}
+
+// Issued returns the issue time of the token. Tokens without iat_ms count
+// as issued at the start of their second.
+func (c Claims) Issued() time.Time {
+	if c.IssuedAtMs != 0 {
+		return time.Unix(0, c.IssuedAtMs*int64(time.Millisecond))
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+func UnixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+type SigningKey struct {
+	ID      string
+	Private ed25519.PrivateKey
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+func SignToken(key SigningKey, claims Claims) (string, error) {
+	h, err := json.Marshal(header{"EdDSA", "JWT", key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return payload + "." + encoding.EncodeToString(ed25519.Sign(key.Private, []byte(payload))), nil
+}
+
+// IsJWT tells JWT access tokens from the opaque ones, which have no dots.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// ParseToken checks the signature and the expiration time of the token and
+// returns its claims. Revocation is checked by the caller.
+func ParseToken(token string, keys func(kid string) (ed25519.PublicKey, bool)) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	var h header
+	var claims Claims
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &h) != nil || h.Alg != "EdDSA" {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	key, ok := keys(h.Kid)
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return Claims{}, ErrInvalidToken
+	}
+	rawClaims, err := encoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil || claims.Issuer != tokenIssuer {
+		return Claims{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func PublicJWK(kid string, key ed25519.PublicKey) JWK {
+	return JWK{"OKP", "Ed25519", encoding.EncodeToString(key), kid, "sig", "EdDSA"}
+}
+
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, errors.New("Unsupported key type " + k.Kty + "/" + k.Crv)
+	}
+	key, err := encoding.DecodeString(k.X)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Malformed Ed25519 key " + k.Kid)
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -3,30 +3,52 @@ package auth
 import (
 	"context"
 	"errors"
-	"os"
+	"net/http"
+	"time"
 
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
 	pbauth "common/proto"
+	"common/tracing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
+// ServiceName is the name the auth server reports its health under.
+const ServiceName = "pbauth.AuthRpc"
+
+type Config struct {
+	Address string `env:"AUTH_RPC_ADDRESS" required:"true"`
+	// JWKSURL enables local verification of JWT access tokens with the keys
+	// published at the url. Other tokens are always validated through RPC.
+	JWKSURL             string        `env:"AUTH_JWKS_URL"`
+	JWKSRefreshInterval time.Duration `env:"AUTH_JWKS_REFRESH_INTERVAL" default:"5m" min:"1s"`
+	// Revocations are polled every RevocationPollInterval. When the list has
+	// not been updated for RevocationMaxAge, tokens are validated through RPC.
+	RevocationPollInterval time.Duration `env:"AUTH_REVOCATION_POLL_INTERVAL" default:"5s" min:"100ms"`
+	RevocationMaxAge       time.Duration `env:"AUTH_REVOCATION_MAX_AGE" default:"30s" min:"1s"`
+}
+
 type AuthClient struct {
 	client     pbauth.AuthRpcClient
 	connection *grpc.ClientConn
+	verifier   *verifier
 }
 
-func CreateAuthClient() (AuthClient, error) {
+func CreateAuthClient(conf Config) (AuthClient, error) {
 	opts := []grpc.DialOption{
 		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(
+			tracing.UnaryClientInterceptor(),
+			logging.UnaryClientInterceptor,
+			metrics.UnaryClientInterceptor),
 	}
 
-	address := os.Getenv("AUTH_RPC_ADDRESS")
-
-	if len(address) == 0 {
-		return AuthClient{}, errors.New("Auth server address is not specified")
-	}
-
-	conn, err := grpc.Dial(address, opts...)
+	conn, err := grpc.Dial(conf.Address, opts...)
 
 	if err != nil {
 		return AuthClient{}, err
@@ -35,24 +57,65 @@ func CreateAuthClient() (AuthClient, error) {
 	client := AuthClient{}
 	client.connection = conn
 	client.client = pbauth.NewAuthRpcClient(conn)
+	if len(conf.JWKSURL) != 0 {
+		client.verifier = createVerifier(conf, client.client)
+	}
 
 	return client, nil
 }
 
+func (c *AuthClient) Close() error {
+	if c.verifier != nil {
+		c.verifier.close()
+	}
+	return c.connection.Close()
+}
+
+// Ping asks the auth server whether it is serving requests, using the
+// standard gRPC health protocol.
+func (c *AuthClient) Ping(ctx context.Context) error {
+	response, err := healthpb.NewHealthClient(c.connection).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: ServiceName})
+	if err != nil {
+		return err
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return errors.New("Auth server is " + response.Status.String())
+	}
+	return nil
+}
+
 type UserPermissions struct {
 	Username    string
 	Permissions []string
 }
 
-func (c *AuthClient) Validate(token string) (UserPermissions, error) {
+func (p UserPermissions) Has(permission string) bool {
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *AuthClient) Validate(ctx context.Context, token string) (UserPermissions, error) {
+	if c.verifier != nil && IsJWT(token) {
+		perms, err := c.verifier.verify(token)
+		if err != errStale {
+			metrics.Validated("local", err)
+			return perms, err
+		}
+	}
 	request := &pbauth.ValidateRequest{
 		AccessToken: token,
 	}
 
-	response, err := c.client.Validate(context.Background(), request)
+	response, err := c.client.Validate(ctx, request)
+	metrics.Validated("rpc", err)
 
 	if err != nil {
-		return UserPermissions{}, err
+		return UserPermissions{}, validateError(err)
 	}
 
 	result := UserPermissions{}
@@ -61,17 +124,32 @@ func (c *AuthClient) Validate(token string) (UserPermissions, error) {
 	return result, nil
 }
 
-var ErrForbidden = errors.New("Not enough permissions")
+var ErrForbidden = httpx.NewError(http.StatusForbidden, "forbidden", "Not enough permissions")
 
-func (c *AuthClient) CheckPermission(token string, permission string) error {
-	perms, err := c.Validate(token)
+// validateError converts the status of a failed call into the error the
+// services respond with: rejected tokens are unauthorized, an unreachable auth
+// server makes the service unavailable.
+func validateError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.Unauthenticated:
+		return httpx.NewError(http.StatusUnauthorized, "unauthorized", s.Message())
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return httpx.NewError(http.StatusServiceUnavailable, "auth_unavailable", "Auth server is unavailable")
+	}
+	return err
+}
+
+func (c *AuthClient) CheckPermission(ctx context.Context, token string, permission string) error {
+	perms, err := c.Validate(ctx, token)
 	if err != nil {
 		return err
 	}
-	for _, p := range perms.Permissions {
-		if p == permission {
-			return nil
-		}
+	if !perms.Has(permission) {
+		return ErrForbidden
 	}
-	return ErrForbidden
+	return nil
 }
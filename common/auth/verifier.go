@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"common/logging"
+	pbauth "common/proto"
+	"common/tracing"
+)
+
+// minKeysRefresh limits refetching of the key set caused by tokens with
+// unknown keys.
+const minKeysRefresh = 10 * time.Second
+
+const fetchTimeout = 5 * time.Second
+
+var errStale = errors.New("Revocation list is out of date")
+
+type revocation struct {
+	revokedAt int64 // milliseconds
+	expiresAt int64
+}
+
+// verifier checks JWT access tokens without calling the auth server. It keeps
+// the published keys and the revocation list, which is polled through RPC.
+type verifier struct {
+	conf   Config
+	client pbauth.AuthRpcClient
+	http   http.Client
+
+	mutex       sync.RWMutex
+	keys        map[string]ed25519.PublicKey
+	keysFetched time.Time
+	users       map[string]revocation
+	tokens      map[string]revocation
+	lastID      int64
+	synced      time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func createVerifier(conf Config, client pbauth.AuthRpcClient) *verifier {
+	v := &verifier{
+		conf:   conf,
+		client: client,
+		keys:   make(map[string]ed25519.PublicKey),
+		users:  make(map[string]revocation),
+		tokens: make(map[string]revocation),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	v.http.Transport = tracing.Transport(logging.Transport{Base: http.DefaultTransport})
+	go v.run()
+	return v
+}
+
+func (v *verifier) run() {
+	defer close(v.done)
+	v.refreshKeys()
+	v.syncRevocations()
+	ticker := time.NewTicker(v.conf.RevocationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+		}
+		v.syncRevocations()
+		v.mutex.RLock()
+		stale := time.Since(v.keysFetched) > v.conf.JWKSRefreshInterval
+		v.mutex.RUnlock()
+		if stale {
+			v.refreshKeys()
+		}
+	}
+}
+
+func (v *verifier) close() {
+	close(v.stop)
+	<-v.done
+}
+
+func (v *verifier) refreshKeys() {
+	v.mutex.Lock()
+	v.keysFetched = time.Now()
+	v.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		logging.Warn("Failed to fetch the key set", logging.Fields{"error": err})
+		return
+	}
+	v.mutex.Lock()
+	v.keys = keys
+	v.mutex.Unlock()
+}
+
+func (v *verifier) fetchKeys(ctx context.Context) (map[string]ed25519.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", v.conf.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := v.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Key set request failed with " + response.Status)
+	}
+	var set JWKS
+	err = json.NewDecoder(response.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			logging.Warn("Skipped published key", logging.Fields{"error": err})
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// syncRevocations fetches the revocations made since the previous call and
+// forgets the ones that outlived the tokens they apply to.
+func (v *verifier) syncRevocations() {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	v.mutex.RLock()
+	after := v.lastID
+	v.mutex.RUnlock()
+	response, err := v.client.GetRevocations(ctx, &pbauth.GetRevocationsRequest{AfterId: after})
+	if err != nil {
+		logging.Warn("Failed to fetch revocations", logging.Fields{"error": err})
+		return
+	}
+	now := time.Now().Unix()
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, r := range response.Revocations {
+		entry := revocation{r.RevokedAtMs, r.ExpiresAt}
+		if entry.revokedAt == 0 {
+			// An older auth server sends whole seconds only.
+			entry.revokedAt = (r.RevokedAt+1)*1000 - 1
+		}
+		if len(r.TokenId) != 0 {
+			v.tokens[r.TokenId] = entry
+		} else if entry.revokedAt > v.users[r.Username].revokedAt {
+			v.users[r.Username] = entry
+		}
+	}
+	for id, entry := range v.tokens {
+		if entry.expiresAt < now {
+			delete(v.tokens, id)
+		}
+	}
+	for username, entry := range v.users {
+		if entry.expiresAt < now {
+			delete(v.users, username)
+		}
+	}
+	if response.LastId > v.lastID {
+		v.lastID = response.LastId
+	}
+	v.synced = time.Now()
+}
+
+func (v *verifier) key(kid string) (ed25519.PublicKey, bool) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// verify returns errStale when the revocation list is too old to rely on,
+// then the token is validated by the auth server.
+func (v *verifier) verify(token string) (UserPermissions, error) {
+	claims, err := ParseToken(token, v.key)
+	if err == ErrUnknownKey {
+		v.mutex.RLock()
+		recent := time.Since(v.keysFetched) < minKeysRefresh
+		v.mutex.RUnlock()
+		if !recent {
+			v.refreshKeys()
+			claims, err = ParseToken(token, v.key)
+		}
+	}
+	if err == ErrUnknownKey {
+		return UserPermissions{}, ErrInvalidToken
+	}
+	if err != nil {
+		return UserPermissions{}, err
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if time.Since(v.synced) > v.conf.RevocationMaxAge {
+		return UserPermissions{}, errStale
+	}
+	if _, ok := v.tokens[claims.ID]; ok {
+		return UserPermissions{}, ErrTokenRevoked
+	}
+	if _, ok := v.tokens[claims.SessionID]; ok && len(claims.SessionID) != 0 {
+		return UserPermissions{}, ErrTokenRevoked
+	}
+	if entry, ok := v.users[claims.Subject]; ok && UnixMs(claims.Issued()) <= entry.revokedAt {
+		return UserPermissions{}, ErrTokenRevoked
+	}
+	return UserPermissions{claims.Subject, claims.Permissions}, nil
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pbauth "common/proto"
+
+	"google.golang.org/grpc"
+)
+
+// fakeAuthRpc serves the revocations with ids greater than the requested one.
+type fakeAuthRpc struct {
+	mutex       sync.Mutex
+	revocations []*pbauth.Revocation
+	lastID      int64
+	requests    []int64
+}
+
+func (f *fakeAuthRpc) Validate(ctx context.Context, in *pbauth.ValidateRequest, opts ...grpc.CallOption) (*pbauth.ValidateResponse, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (f *fakeAuthRpc) GetRevocations(ctx context.Context, in *pbauth.GetRevocationsRequest, opts ...grpc.CallOption) (*pbauth.GetRevocationsResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, in.AfterId)
+	response := &pbauth.GetRevocationsResponse{LastId: f.lastID}
+	for _, r := range f.revocations {
+		if r.Id > in.AfterId {
+			response.Revocations = append(response.Revocations, r)
+		}
+	}
+	return response, nil
+}
+
+func (f *fakeAuthRpc) add(r *pbauth.Revocation) {
+	f.mutex.Lock()
+	f.revocations = append(f.revocations, r)
+	f.lastID = r.Id
+	f.mutex.Unlock()
+}
+
+// keySet publishes keys as a JWKS and counts the fetches.
+type keySet struct {
+	mutex   sync.Mutex
+	keys    []JWK
+	fetches int
+}
+
+func (s *keySet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fetches++
+	json.NewEncoder(w).Encode(JWKS{Keys: s.keys})
+}
+
+func (s *keySet) publish(key SigningKey) {
+	s.mutex.Lock()
+	s.keys = append(s.keys, PublicJWK(key.ID, key.Private.Public().(ed25519.PublicKey)))
+	s.mutex.Unlock()
+}
+
+func newKey(t *testing.T, id string) SigningKey {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SigningKey{id, private}
+}
+
+func sign(t *testing.T, key SigningKey, claims Claims) string {
+	token, err := SignToken(key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func claimsAt(issued time.Time) Claims {
+	return Claims{
+		Issuer:     tokenIssuer,
+		Subject:    "user",
+		IssuedAt:   issued.Unix(),
+		IssuedAtMs: UnixMs(issued),
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+		ID:         "token",
+		SessionID:  "session",
+	}
+}
+
+// newTestVerifier returns a synced verifier without the polling goroutine.
+// The key set server has to be closed by the caller.
+func newTestVerifier(t *testing.T, rpc *fakeAuthRpc, keys *keySet) (*verifier, *httptest.Server) {
+	server := httptest.NewServer(keys)
+	v := &verifier{
+		conf:   Config{JWKSURL: server.URL, RevocationMaxAge: time.Minute},
+		client: rpc,
+		keys:   make(map[string]ed25519.PublicKey),
+		users:  make(map[string]revocation),
+		tokens: make(map[string]revocation),
+	}
+	v.refreshKeys()
+	v.syncRevocations()
+	return v, server
+}
+
+func TestVerify(t *testing.T) {
+	key := newKey(t, "key")
+	other := newKey(t, "key")
+	keys := &keySet{}
+	keys.publish(key)
+	rpc := &fakeAuthRpc{}
+	// In the middle of a second, so tokens a millisecond apart share it.
+	revokedAt := time.Unix(time.Now().Unix()-60, 500*int64(time.Millisecond))
+	rpc.add(&pbauth.Revocation{Id: 1, TokenId: "revoked-token", RevokedAt: revokedAt.Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	rpc.add(&pbauth.Revocation{Id: 2, TokenId: "revoked-session", RevokedAt: revokedAt.Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	rpc.add(&pbauth.Revocation{Id: 3, Username: "user", RevokedAt: revokedAt.Unix(), RevokedAtMs: UnixMs(revokedAt), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	rpc.add(&pbauth.Revocation{Id: 4, Username: "legacy", RevokedAt: revokedAt.Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	v, server := newTestVerifier(t, rpc, keys)
+	defer server.Close()
+
+	header := func(h string) string {
+		return encoding.EncodeToString([]byte(h))
+	}
+	valid := sign(t, key, claimsAt(time.Now()))
+	parts := strings.Split(valid, ".")
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"malformed", "a.b", ErrInvalidToken},
+		{"alg none", header(`{"alg":"none","typ":"JWT","kid":"key"}`) + "." + parts[1] + ".", ErrInvalidToken},
+		{"alg HS256", header(`{"alg":"HS256","typ":"JWT","kid":"key"}`) + "." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"wrong key", sign(t, other, claimsAt(time.Now())), ErrInvalidToken},
+		{"unknown kid", sign(t, newKey(t, "unknown"), claimsAt(time.Now())), ErrInvalidToken},
+		{"wrong issuer", sign(t, key, func() Claims {
+			c := claimsAt(time.Now())
+			c.Issuer = "someone"
+			return c
+		}()), ErrInvalidToken},
+		{"expired", sign(t, key, func() Claims {
+			c := claimsAt(time.Now())
+			c.ExpiresAt = time.Now().Unix()
+			return c
+		}()), ErrTokenExpired},
+		{"revoked token", sign(t, key, func() Claims {
+			c := claimsAt(time.Now())
+			c.ID = "revoked-token"
+			return c
+		}()), ErrTokenRevoked},
+		{"revoked session", sign(t, key, func() Claims {
+			c := claimsAt(time.Now())
+			c.SessionID = "revoked-session"
+			return c
+		}()), ErrTokenRevoked},
+		{"issued before user revocation", sign(t, key, claimsAt(revokedAt.Add(-time.Millisecond))), ErrTokenRevoked},
+		{"issued with user revocation", sign(t, key, claimsAt(revokedAt)), ErrTokenRevoked},
+		{"issued after user revocation", sign(t, key, claimsAt(revokedAt.Add(time.Millisecond))), nil},
+		{"no iat_ms", sign(t, key, func() Claims {
+			c := claimsAt(revokedAt.Add(time.Millisecond))
+			c.IssuedAtMs = 0
+			return c
+		}()), ErrTokenRevoked},
+		{"revocation in seconds", sign(t, key, func() Claims {
+			c := claimsAt(time.Unix(revokedAt.Unix(), 999*int64(time.Millisecond)))
+			c.Subject = "legacy"
+			return c
+		}()), ErrTokenRevoked},
+		{"issued after revocation in seconds", sign(t, key, func() Claims {
+			c := claimsAt(time.Unix(revokedAt.Unix()+1, 0))
+			c.Subject = "legacy"
+			return c
+		}()), nil},
+	}
+	for _, test := range tests {
+		user, err := v.verify(test.token)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if err == nil && user.Username == "" {
+			t.Errorf("%s: no user", test.name)
+		}
+	}
+}
+
+func TestVerifyRefreshesKeys(t *testing.T) {
+	key := newKey(t, "key")
+	keys := &keySet{}
+	v, server := newTestVerifier(t, &fakeAuthRpc{}, keys)
+	defer server.Close()
+	keys.publish(key)
+	token := sign(t, key, claimsAt(time.Now()))
+
+	// The key set was fetched just now, so the new key isn't seen yet.
+	_, err := v.verify(token)
+	if err != ErrInvalidToken {
+		t.Fatalf("Got error %v, want %v", err, ErrInvalidToken)
+	}
+	if keys.fetches != 1 {
+		t.Fatalf("Fetched the key set %d times, want 1", keys.fetches)
+	}
+	v.keysFetched = time.Now().Add(-minKeysRefresh)
+	_, err = v.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.fetches != 2 {
+		t.Fatalf("Fetched the key set %d times, want 2", keys.fetches)
+	}
+	_, err = v.verify(sign(t, newKey(t, "unknown"), claimsAt(time.Now())))
+	if err != ErrInvalidToken {
+		t.Fatalf("Got error %v, want %v", err, ErrInvalidToken)
+	}
+	if keys.fetches != 2 {
+		t.Fatalf("Fetched the key set %d times, want 2", keys.fetches)
+	}
+}
+
+func TestVerifyStale(t *testing.T) {
+	key := newKey(t, "key")
+	keys := &keySet{}
+	keys.publish(key)
+	v, server := newTestVerifier(t, &fakeAuthRpc{}, keys)
+	defer server.Close()
+	v.synced = time.Now().Add(-2 * time.Minute)
+	_, err := v.verify(sign(t, key, claimsAt(time.Now())))
+	if err != errStale {
+		t.Fatalf("Got error %v, want %v", err, errStale)
+	}
+}
+
+func TestSyncRevocations(t *testing.T) {
+	now := time.Now()
+	rpc := &fakeAuthRpc{}
+	rpc.add(&pbauth.Revocation{Id: 1, Username: "user", RevokedAtMs: UnixMs(now), ExpiresAt: now.Add(time.Hour).Unix()})
+	rpc.add(&pbauth.Revocation{Id: 2, TokenId: "expired", RevokedAtMs: UnixMs(now), ExpiresAt: now.Add(-time.Second).Unix()})
+	v, server := newTestVerifier(t, rpc, &keySet{})
+	defer server.Close()
+	rpc.add(&pbauth.Revocation{Id: 3, Username: "user", RevokedAtMs: UnixMs(now.Add(-time.Minute)), ExpiresAt: now.Add(time.Hour).Unix()})
+	// The server hasn't settled id 3 yet and reports it again next time.
+	rpc.mutex.Lock()
+	rpc.lastID = 2
+	rpc.mutex.Unlock()
+	v.syncRevocations()
+	v.syncRevocations()
+
+	if want := []int64{0, 2, 2}; len(rpc.requests) != len(want) || rpc.requests[1] != want[1] || rpc.requests[2] != want[2] {
+		t.Errorf("Requested after %v, want %v", rpc.requests, want)
+	}
+	if v.lastID != 2 {
+		t.Errorf("Got last id %d, want 2", v.lastID)
+	}
+	if _, ok := v.tokens["expired"]; ok {
+		t.Error("Kept an expired revocation")
+	}
+	// An older revocation doesn't replace a newer one.
+	if v.users["user"].revokedAt != UnixMs(now) {
+		t.Errorf("Got user revocation at %d, want %d", v.users["user"].revokedAt, UnixMs(now))
+	}
+}
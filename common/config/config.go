@@ -0,0 +1,334 @@
+// Package config fills typed config structs from environment variables.
+// Fields are described with tags:
+//
+//	env:"NAME"        the variable the value is read from
+//	default:"value"   used when the variable is not set
+//	required:"true"   the variable must be set and not empty
+//	min:"1" max:"10"  bounds of numbers and durations
+//	oneof:"a,b"       allowed values of strings
+//	secret:"true"     the value is hidden by --print-config
+//
+// Supported types are strings, integers, booleans, floats, time.Duration,
+// comma-separated []string and pointers to them; a pointer stays nil when
+// the variable is not set and there is no default. Nested structs without
+// the env tag are loaded recursively. A pointer to a nested struct tagged
+// when:"NAME" is loaded only when the variable NAME is set, otherwise it
+// stays nil and its variables aren't required.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error lists every problem found in the configuration.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "Invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+type field struct {
+	name  string
+	tag   reflect.StructTag
+	value reflect.Value
+}
+
+// fields lists the variables of v. Optional nested structs are allocated
+// when enabled reports their when variable as set; with a nil enabled only
+// the already allocated ones are listed.
+func fields(v reflect.Value, result []field, enabled func(name string) bool) []field {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup("env")
+		if !ok {
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Type.Kind() == reflect.Struct {
+				result = fields(v.Field(i), result, enabled)
+			}
+			if f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct {
+				nested := v.Field(i)
+				when, ok := f.Tag.Lookup("when")
+				if nested.IsNil() && ok && enabled != nil && enabled(when) {
+					nested.Set(reflect.New(f.Type.Elem()))
+				}
+				if !nested.IsNil() {
+					result = fields(nested.Elem(), result, enabled)
+				}
+			}
+			continue
+		}
+		result = append(result, field{name, f.Tag, v.Field(i)})
+	}
+	return result
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func parse(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if t == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return v, errors.New("should be a duration, e.g. 30s or 5m")
+		}
+		v.SetInt(int64(d))
+		return v, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, errors.New("should be true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, errors.New("should be an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, errors.New("should be a non-negative integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, errors.New("should be a number")
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.String {
+			return v, errors.New("has unsupported type " + t.String())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items).Convert(t))
+	case reflect.Ptr:
+		elem, err := parse(t.Elem(), s)
+		if err != nil {
+			return v, err
+		}
+		v.Set(reflect.New(t.Elem()))
+		v.Elem().Set(elem)
+	default:
+		return v, errors.New("has unsupported type " + t.String())
+	}
+	return v, nil
+}
+
+// less compares numbers and durations of the same type.
+func less(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return false
+}
+
+func validate(f field, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if bound, ok := f.tag.Lookup("min"); ok {
+		min, err := parse(v.Type(), bound)
+		if err == nil && less(v, min) {
+			return errors.New("should be at least " + bound)
+		}
+	}
+	if bound, ok := f.tag.Lookup("max"); ok {
+		max, err := parse(v.Type(), bound)
+		if err == nil && less(max, v) {
+			return errors.New("should be at most " + bound)
+		}
+	}
+	if options, ok := f.tag.Lookup("oneof"); ok && v.Kind() == reflect.String {
+		for _, option := range strings.Split(options, ",") {
+			if v.String() == option {
+				return nil
+			}
+		}
+		return errors.New("should be one of " + options)
+	}
+	return nil
+}
+
+// Source returns the value of a variable and whether it is set.
+type Source func(name string) (string, bool)
+
+func (s Source) load(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("config: Load expects a pointer to a struct")
+	}
+	set := func(name string) bool {
+		raw, ok := s(name)
+		return ok && len(raw) != 0
+	}
+	var problems []string
+	for _, f := range fields(rv.Elem(), nil, set) {
+		raw, ok := s(f.name)
+		if !ok || len(raw) == 0 {
+			if f.tag.Get("required") == "true" {
+				problems = append(problems, f.name+" is required")
+				continue
+			}
+			raw, ok = f.tag.Lookup("default")
+			if !ok {
+				continue
+			}
+		}
+		value, err := parse(f.value.Type(), raw)
+		if err == nil {
+			err = validate(f, value)
+		}
+		if err != nil {
+			problems = append(problems, f.name+" "+err.Error())
+			continue
+		}
+		f.value.Set(value)
+	}
+	if len(problems) != 0 {
+		return &Error{problems}
+	}
+	return nil
+}
+
+// LoadFrom fills v from the source.
+func LoadFrom(s Source, v interface{}) error {
+	return s.load(v)
+}
+
+// ReadFile reads variables from a file of NAME=value lines. Empty lines and
+// lines starting with # are skipped, values may be quoted.
+func ReadFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readVars(file)
+}
+
+func readVars(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		eq := strings.Index(text, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected NAME=value", line)
+		}
+		name := strings.TrimSpace(text[:eq])
+		value := strings.TrimSpace(text[eq+1:])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		vars[name] = value
+	}
+	return vars, scanner.Err()
+}
+
+// Environment looks variables up in the process environment first and then
+// in the file vars.
+func Environment(file map[string]string) Source {
+	return func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := file[name]
+		return value, ok
+	}
+}
+
+// Print writes the configuration as NAME=value lines, secrets are replaced
+// by a placeholder.
+func Print(w io.Writer, v interface{}) {
+	for _, f := range fields(reflect.ValueOf(v).Elem(), nil, nil) {
+		value := f.value
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				fmt.Fprintf(w, "%s=\n", f.name)
+				continue
+			}
+			value = value.Elem()
+		}
+		text := fmt.Sprint(value.Interface())
+		if value.Kind() == reflect.Slice {
+			text = strings.Trim(text, "[]")
+			text = strings.Replace(text, " ", ",", -1)
+		}
+		if f.tag.Get("secret") == "true" && len(text) != 0 {
+			text = "[REDACTED]"
+		}
+		fmt.Fprintf(w, "%s=%s\n", f.name, text)
+	}
+}
+
+// MustLoad is meant to be the first call in main. It fills v from the
+// environment and the file given by --config or CONFIG_FILE, the environment
+// takes precedence. With --print-config the resulting configuration is
+// printed and the process exits. Invalid configuration is reported with all
+// its problems and the process exits with code 2.
+func MustLoad(v interface{}) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "file with NAME=value lines")
+	printConfig := flags.Bool("print-config", false, "print the configuration and exit")
+	flags.Parse(os.Args[1:])
+	var file map[string]string
+	if len(*path) != 0 {
+		var err error
+		file, err = ReadFile(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read config file %s: %v\n", *path, err)
+			os.Exit(2)
+		}
+	}
+	err := LoadFrom(Environment(file), v)
+	if *printConfig {
+		Print(os.Stdout, v)
+	}
+	if err != nil {
+		if cerr, ok := err.(*Error); ok {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:")
+			for _, problem := range cerr.Problems {
+				fmt.Fprintln(os.Stderr, "  "+problem)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+	if *printConfig {
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nested struct {
+	Address string `env:"NESTED_ADDRESS" required:"true"`
+}
+
+type testConfig struct {
+	Name     string        `env:"NAME" required:"true"`
+	Mode     string        `env:"MODE" default:"fast" oneof:"fast,slow"`
+	Workers  int           `env:"WORKERS" default:"4" min:"1" max:"16"`
+	Timeout  time.Duration `env:"TIMEOUT" default:"30s" min:"1s"`
+	Hosts    []string      `env:"HOSTS"`
+	Limit    *uint         `env:"LIMIT"`
+	Password string        `env:"PASSWORD" secret:"true"`
+	Enabled  string        `env:"ENABLED"`
+	Optional *nested       `when:"ENABLED"`
+}
+
+func source(vars map[string]string) Source {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	var conf testConfig
+	err := LoadFrom(source(map[string]string{
+		"NAME":     "service",
+		"WORKERS":  "8",
+		"HOSTS":    "a, b,,c",
+		"LIMIT":    "5",
+		"PASSWORD": "secret",
+	}), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Name != "service" || conf.Mode != "fast" || conf.Workers != 8 || conf.Timeout != 30*time.Second {
+		t.Errorf("Got %+v", conf)
+	}
+	if strings.Join(conf.Hosts, "|") != "a|b|c" {
+		t.Errorf("Got hosts %q", conf.Hosts)
+	}
+	if conf.Limit == nil || *conf.Limit != 5 {
+		t.Errorf("Got limit %v", conf.Limit)
+	}
+	if conf.Optional != nil {
+		t.Errorf("Loaded the optional struct without ENABLED: %+v", conf.Optional)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		vars     map[string]string
+		problems []string
+	}{
+		{"valid", map[string]string{"NAME": "a"}, nil},
+		{"missing", map[string]string{}, []string{"NAME is required"}},
+		{"empty", map[string]string{"NAME": ""}, []string{"NAME is required"}},
+		{"bounds", map[string]string{"NAME": "a", "WORKERS": "0", "TIMEOUT": "10ms"}, []string{
+			"WORKERS should be at least 1", "TIMEOUT should be at least 1s"}},
+		{"max", map[string]string{"NAME": "a", "WORKERS": "17"}, []string{"WORKERS should be at most 16"}},
+		{"types", map[string]string{"NAME": "a", "WORKERS": "many", "TIMEOUT": "30", "LIMIT": "-1"}, []string{
+			"WORKERS should be an integer", "TIMEOUT should be a duration, e.g. 30s or 5m",
+			"LIMIT should be a non-negative integer"}},
+		{"oneof", map[string]string{"NAME": "a", "MODE": "medium"}, []string{"MODE should be one of fast,slow"}},
+		{"optional struct", map[string]string{"NAME": "a", "ENABLED": "yes"}, []string{"NESTED_ADDRESS is required"}},
+		{"optional struct set", map[string]string{"NAME": "a", "ENABLED": "yes", "NESTED_ADDRESS": "host"}, nil},
+	}
+	for _, test := range tests {
+		var conf testConfig
+		err := LoadFrom(source(test.vars), &conf)
+		var problems []string
+		if err != nil {
+			cerr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("%s: got %v", test.name, err)
+			}
+			problems = cerr.Problems
+		}
+		if strings.Join(problems, "; ") != strings.Join(test.problems, "; ") {
+			t.Errorf("%s: got problems %q, want %q", test.name, problems, test.problems)
+		}
+	}
+}
+
+func TestEnvironmentPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.env")
+	err = ioutil.WriteFile(path, []byte("# comment\n\nNAME = \"from file\"\nMODE=slow\nWORKERS=2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("WORKERS", "3")
+	defer os.Unsetenv("WORKERS")
+	var conf testConfig
+	err = LoadFrom(Environment(file), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Name != "from file" || conf.Mode != "slow" || conf.Workers != 3 {
+		t.Errorf("Got %+v", conf)
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	_, err := readVars(strings.NewReader("NAME=a\njust text\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Got %v, want an error at line 2", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	var conf testConfig
+	err := LoadFrom(source(map[string]string{
+		"NAME": "service", "HOSTS": "a,b", "PASSWORD": "secret", "ENABLED": "yes", "NESTED_ADDRESS": "host",
+	}), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	Print(&out, &conf)
+	want := "NAME=service\nMODE=fast\nWORKERS=4\nTIMEOUT=30s\nHOSTS=a,b\nLIMIT=\n" +
+		"PASSWORD=[REDACTED]\nENABLED=yes\nNESTED_ADDRESS=host\n"
+	if out.String() != want {
+		t.Errorf("Got\n%s\nwant\n%s", out.String(), want)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Error("Printed the secret")
+	}
+
+	// Empty secrets are printed as empty, optional structs that weren't
+	// loaded are omitted.
+	conf = testConfig{Name: "service"}
+	out.Reset()
+	Print(&out, &conf)
+	if !strings.Contains(out.String(), "PASSWORD=\n") || strings.Contains(out.String(), "NESTED_ADDRESS") {
+		t.Errorf("Got\n%s", out.String())
+	}
+}
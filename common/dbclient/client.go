@@ -4,21 +4,29 @@ import (
 	"context"
 	"errors"
 	"hash/crc64"
-	"os"
 	"strconv"
+	"time"
+
+	"common/metrics"
+	"common/tracing"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+type Config struct {
+	URL string `env:"DATABASE_URL" required:"true" secret:"true"`
+}
+
 type Client struct {
-	connection *pgx.Conn
+	connection *pgxpool.Pool
 }
 
 var ErrNotFound = errors.New("Specified item doesn't exist")
 
-func CreateDbClient() (Client, error) {
+func CreateDbClient(conf Config) (Client, error) {
 	db := Client{}
-	conn, err := pgx.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	conn, err := pgxpool.Connect(context.Background(), conf.URL)
 	if err != nil {
 		return Client{}, err
 	}
@@ -30,9 +38,32 @@ func CreateDbClient() (Client, error) {
 			title text not null,
 			category text not null
 		);`)
+	if err != nil {
+		return Client{}, err
+	}
+	_, err = db.connection.Exec(context.Background(),
+		`create table if not exists processed_batches (
+			id text primary key,
+			processed_at timestamp not null default now()
+		);`)
+	if err != nil {
+		return Client{}, err
+	}
+	_, err = db.connection.Exec(context.Background(),
+		`create index if not exists processed_batches_processed_at
+			on processed_batches (processed_at);`)
 	return db, err
 }
 
+func (db *Client) Close() {
+	db.connection.Close()
+}
+
+func (db *Client) Ping(ctx context.Context) error {
+	_, err := db.connection.Exec(ctx, "select 1")
+	return err
+}
+
 type Item struct {
 	ID            uint64 `json:"id"`
 	UniversalCode string `json:"universal_code"`
@@ -48,12 +79,15 @@ func (item *Item) GenerateUniversalCode() {
 		16)
 }
 
-func (db *Client) NewItem(item Item) (uint64, error) {
+func (db *Client) NewItem(ctx context.Context, item Item) (uint64, error) {
+	defer metrics.ObserveQuery("new_item", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "new_item")
+	defer span.End()
 	if item.UniversalCode == "" {
 		item.GenerateUniversalCode()
 	}
 	var id uint64
-	err := db.connection.QueryRow(context.Background(),
+	err := db.connection.QueryRow(ctx,
 		`insert into items (universal_code, title, category)
 		values ($1, $2, $3)
 		returning id;
@@ -64,11 +98,14 @@ func (db *Client) NewItem(item Item) (uint64, error) {
 	return id, nil
 }
 
-func (db *Client) UpdateItem(item Item) error {
+func (db *Client) UpdateItem(ctx context.Context, item Item) error {
+	defer metrics.ObserveQuery("update_item", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "update_item")
+	defer span.End()
 	if item.UniversalCode == "" {
 		item.GenerateUniversalCode()
 	}
-	tags, err := db.connection.Exec(context.Background(),
+	tags, err := db.connection.Exec(ctx,
 		`update items
 		set universal_code = $1
 			title = $2
@@ -81,8 +118,11 @@ func (db *Client) UpdateItem(item Item) error {
 	return err
 }
 
-func (db *Client) DeleteItem(id uint64) error {
-	tags, err := db.connection.Exec(context.Background(),
+func (db *Client) DeleteItem(ctx context.Context, id uint64) error {
+	defer metrics.ObserveQuery("delete_item", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_item")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
 		`delete from items
 		where id = $1;
 		`, id)
@@ -92,9 +132,12 @@ func (db *Client) DeleteItem(id uint64) error {
 	return err
 }
 
-func (db *Client) GetItem(id uint64) (Item, error) {
+func (db *Client) GetItem(ctx context.Context, id uint64) (Item, error) {
+	defer metrics.ObserveQuery("get_item", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_item")
+	defer span.End()
 	var item Item
-	err := db.connection.QueryRow(context.Background(),
+	err := db.connection.QueryRow(ctx,
 		`select id, universal_code, title, category from items where id = $1
 		`, id).Scan(&item.ID, &item.UniversalCode, &item.Title, &item.Category)
 	if err == pgx.ErrNoRows {
@@ -109,16 +152,20 @@ type GetItemListOptions struct {
 	Categories []string // Unsupported yet
 }
 
-func (db *Client) GetItemList(options GetItemListOptions) ([]Item, error) {
+func (db *Client) GetItemList(ctx context.Context, options GetItemListOptions) ([]Item, error) {
+	defer metrics.ObserveQuery("get_item_list", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_item_list")
+	defer span.End()
 	query := `select id, universal_code, title, category from items
 		order by id
 		offset $1
 		limit $2`
-	rows, err := db.connection.Query(context.Background(), query,
+	rows, err := db.connection.Query(ctx, query,
 		options.Offset, options.Limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	res := make([]Item, 0)
 	for rows.Next() {
 		var item Item
@@ -128,28 +175,85 @@ func (db *Client) GetItemList(options GetItemListOptions) ([]Item, error) {
 		}
 		res = append(res, item)
 	}
-	return res, nil
+	return res, rows.Err()
 }
 
-func (db *Client) GetItemListSize() (int, error) {
+func (db *Client) GetItemListSize(ctx context.Context) (int, error) {
+	defer metrics.ObserveQuery("get_item_list_size", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "get_item_list_size")
+	defer span.End()
 	var size int
-	err := db.connection.QueryRow(context.Background(),
+	err := db.connection.QueryRow(ctx,
 		`select count(*) from items`).Scan(&size)
 	return size, err
 }
 
-func (db *Client) ImportItemBatch(batch []Item) error {
+type ItemBatch struct {
+	ID    string `json:"id"`
+	Items []Item `json:"items"`
+}
+
+// ImportItemBatches inserts items of all batches in one transaction, items
+// with already existing universal codes are skipped. Batch ids are recorded
+// in the same transaction, so a batch that has been imported before is
+// skipped as a whole. A nil result means everything is committed.
+func (db *Client) ImportItemBatches(ctx context.Context, batches []ItemBatch) error {
+	defer metrics.ObserveQuery("import_item_batches", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "import_item_batches")
+	defer span.End()
+	tx, err := db.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 	dbbatch := &pgx.Batch{}
 	query := `insert into items (universal_code, title, category)
 		values ($1, $2, $3) ON CONFLICT DO NOTHING`
-	for _, item := range batch {
-		if item.UniversalCode == "" {
-			item.GenerateUniversalCode()
+	for _, batch := range batches {
+		if batch.ID != "" {
+			tags, err := tx.Exec(ctx,
+				`insert into processed_batches (id) values ($1)
+				ON CONFLICT DO NOTHING`, batch.ID)
+			if err != nil {
+				return err
+			}
+			if tags.RowsAffected() == 0 {
+				continue
+			}
+		}
+		for _, item := range batch.Items {
+			if item.UniversalCode == "" {
+				item.GenerateUniversalCode()
+			}
+			dbbatch.Queue(query, item.UniversalCode, item.Title, item.Category)
 		}
-		dbbatch.Queue(query, item.UniversalCode, item.Title, item.Category)
 	}
-	batch_results := db.connection.SendBatch(context.Background(), dbbatch)
-	defer batch_results.Close()
-	_, err := batch_results.Exec()
-	return err
+	if dbbatch.Len() != 0 {
+		batch_results := tx.SendBatch(ctx, dbbatch)
+		for i := 0; i < dbbatch.Len(); i++ {
+			_, err = batch_results.Exec()
+			if err != nil {
+				batch_results.Close()
+				return err
+			}
+		}
+		err = batch_results.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteProcessedBatches forgets the ids of batches processed more than
+// retention ago, such batches are not expected to be delivered again. The
+// age is computed by the database, which sets processed_at.
+func (db *Client) DeleteProcessedBatches(ctx context.Context, retention time.Duration) (int64, error) {
+	defer metrics.ObserveQuery("delete_processed_batches", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "delete_processed_batches")
+	defer span.End()
+	tags, err := db.connection.Exec(ctx,
+		`delete from processed_batches where processed_at < now() - $1 * interval '1 second'`,
+		int64(retention/time.Second))
+	return tags.RowsAffected(), err
 }
@@ -5,6 +5,10 @@ go 1.13
 require (
 	github.com/golang/protobuf v1.4.0
 	github.com/jackc/pgx/v4 v4.6.0
+	github.com/prometheus/client_golang v1.6.0
+	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
 	google.golang.org/grpc v1.29.1
 	google.golang.org/protobuf v1.21.0
 )
@@ -0,0 +1,126 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"common/logging"
+)
+
+const checkTimeout = 2 * time.Second
+
+var ErrShuttingDown = errors.New("Service is shutting down")
+
+type check struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// Health serves two probes: /healthz reports that the process is alive and
+// /readyz that every registered dependency is reachable. Readiness is also
+// withdrawn as soon as the shutdown starts; Shutdown.Drain then waits for
+// load balancers to notice it before the listeners are closed.
+type Health struct {
+	mutex    sync.Mutex
+	checks   []check
+	stopping bool
+}
+
+func CreateHealth() *Health {
+	return &Health{}
+}
+
+func (h *Health) Add(name string, f func(ctx context.Context) error) {
+	h.mutex.Lock()
+	h.checks = append(h.checks, check{name, f})
+	h.mutex.Unlock()
+}
+
+// AddPing registers a check that doesn't accept a context.
+func (h *Health) AddPing(name string, f func() error) {
+	h.Add(name, func(ctx context.Context) error {
+		return f()
+	})
+}
+
+// Stop makes the service unready. It has the signature of a shutdown step.
+func (h *Health) Stop(ctx context.Context) error {
+	h.mutex.Lock()
+	h.stopping = true
+	h.mutex.Unlock()
+	return nil
+}
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func respond(w http.ResponseWriter, result response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Health) liveHandler(w http.ResponseWriter, r *http.Request) {
+	respond(w, response{Status: "ok"})
+}
+
+// Ready runs all checks in parallel and returns their errors by name.
+func (h *Health) Ready(ctx context.Context) map[string]error {
+	h.mutex.Lock()
+	checks := h.checks
+	stopping := h.stopping
+	h.mutex.Unlock()
+	result := make(map[string]error)
+	if stopping {
+		result["shutdown"] = ErrShuttingDown
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+			err := c.f(ctx)
+			mutex.Lock()
+			result[c.name] = err
+			mutex.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return result
+}
+
+// readyHandler reports only the status of each check: /readyz is public and
+// errors may mention hosts and users, so they are logged instead.
+func (h *Health) readyHandler(w http.ResponseWriter, r *http.Request) {
+	result := response{Status: "ok", Checks: make(map[string]string)}
+	for name, err := range h.Ready(r.Context()) {
+		if err != nil {
+			result.Status = "fail"
+			result.Checks[name] = "fail"
+			if err != ErrShuttingDown {
+				logging.FromContext(r.Context()).Warn("Readiness check failed", logging.Fields{"check": name, "error": err})
+			}
+		} else {
+			result.Checks[name] = "ok"
+		}
+	}
+	respond(w, result)
+}
+
+// Register adds /healthz and /readyz to the mux.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.liveHandler)
+	mux.HandleFunc("/readyz", h.readyHandler)
+}
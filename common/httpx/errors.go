@@ -0,0 +1,85 @@
+package httpx
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"common/logging"
+)
+
+// Error is an error with the HTTP status and the machine-readable code it is
+// reported with.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(status int, code string, message string) *Error {
+	return &Error{status, code, message}
+}
+
+func BadRequest(err error) *Error {
+	return &Error{http.StatusBadRequest, "bad_request", err.Error()}
+}
+
+func Unauthorized(err error) *Error {
+	return &Error{http.StatusUnauthorized, "unauthorized", err.Error()}
+}
+
+func Forbidden(err error) *Error {
+	return &Error{http.StatusForbidden, "forbidden", err.Error()}
+}
+
+func NotFound(err error) *Error {
+	return &Error{http.StatusNotFound, "not_found", err.Error()}
+}
+
+func Conflict(err error) *Error {
+	return &Error{http.StatusConflict, "conflict", err.Error()}
+}
+
+// ErrorResponse is the body of every error response. Error is kept as a plain
+// string for the clients written against the older responses.
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func RespondJSON(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func RespondOK(w http.ResponseWriter, result interface{}) {
+	RespondJSON(w, http.StatusOK, result)
+}
+
+// RespondError writes err in the error envelope. Errors other than *Error are
+// logged and reported as internal ones without the details.
+func RespondError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		logging.FromContext(r.Context()).Error("Request failed", logging.Fields{
+			"method": r.Method,
+			"error":  err,
+		})
+		e = &Error{http.StatusInternalServerError, "internal", "Internal server error"}
+	}
+	RespondJSON(w, e.Status, ErrorResponse{e.Message, e.Code, logging.RequestID(r.Context())})
+}
+
+// DecodeJSON reads the request body into v.
+func DecodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return NewError(http.StatusBadRequest, "invalid_body", "Invalid request body: "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
+)
+
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain wraps h so that mw[0] is the outermost middleware.
+func Chain(h http.HandlerFunc, mw ...Middleware) http.HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return metrics.InstrumentHandler(route, tracing.Handler(route, logging.Middleware(route, Recover(h))))
+}
+
+// Recover turns a panic of the handler into an internal error response.
+func Recover(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logging.FromContext(r.Context()).Error("Handler panicked", logging.Fields{
+				"panic": fmt.Sprint(p),
+				"stack": string(debug.Stack()),
+			})
+			RespondError(w, r, NewError(http.StatusInternalServerError, "internal", "Internal server error"))
+		}()
+		h(w, r)
+	}
+}
+
+type CORSConfig struct {
+	// Origins allowed to call the service from browsers, * allows any. CORS
+	// headers are not sent when the list is empty.
+	Origins []string      `env:"CORS_ALLOWED_ORIGINS"`
+	MaxAge  time.Duration `env:"CORS_MAX_AGE" default:"10m" min:"0s"`
+}
+
+// CORS answers preflight requests of the allowed origins and lets browsers
+// read the exposed response headers in addition to X-Request-ID.
+func CORS(conf CORSConfig, exposed ...string) Middleware {
+	allowed := make(map[string]bool)
+	for _, origin := range conf.Origins {
+		allowed[origin] = true
+	}
+	exposed = append([]string{logging.RequestIDHeader}, exposed...)
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		if len(allowed) == 0 {
+			return h
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if len(origin) == 0 || !(allowed[origin] || allowed["*"]) {
+				h(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			method := r.Header.Get("Access-Control-Request-Method")
+			if r.Method != http.MethodOptions || len(method) == 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+				h(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", method)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); len(headers) != 0 {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(conf.MaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+type ProxyConfig struct {
+	// Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is
+	// trusted. When the list is empty the client is the connected peer.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+}
+
+type clientIPKey struct{}
+
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid proxy address '%s'", proxy)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy range '%s'", proxy)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// TrustProxies makes ClientIP take the client address from X-Forwarded-For
+// of requests that come from a trusted proxy. The rightmost address that
+// isn't a trusted proxy is the client, addresses to the left of it are set
+// by the client and can be forged.
+func TrustProxies(conf ProxyConfig) (Middleware, error) {
+	nets, err := parseProxies(conf.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		if len(nets) == 0 {
+			return h
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			client := ClientIP(r)
+			if trusted(client) {
+				forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+				for i := len(forwarded) - 1; i >= 0; i-- {
+					addr := strings.TrimSpace(forwarded[i])
+					if net.ParseIP(addr) == nil {
+						break
+					}
+					client = addr
+					if !trusted(addr) {
+						break
+					}
+				}
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, client)))
+		}
+	}, nil
+}
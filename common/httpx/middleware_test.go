@@ -0,0 +1,58 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustProxies(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   []string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"no proxies", nil, "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"single address", []string{"10.0.0.2"}, "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"no header", []string{"10.0.0.0/8"}, "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"forged left part", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"several headers", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"1.2.3.4", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"only proxies", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"garbage", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"1.2.3.4, unknown"}, "10.0.0.2"},
+		{"garbage on the left", []string{"10.0.0.0/8"}, "10.0.0.2:1234", []string{"unknown, 198.51.100.1"}, "198.51.100.1"},
+		{"ipv6", []string{"fd00::/8"}, "[fd00::2]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		trust, err := TrustProxies(ProxyConfig{test.trusted})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got string
+		handler := trust(func(w http.ResponseWriter, r *http.Request) {
+			got = ClientIP(r)
+		})
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		handler(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%s: got client %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTrustProxiesRejectsInvalid(t *testing.T) {
+	for _, proxy := range []string{"10.0.0.0/33", "proxy.local", ""} {
+		_, err := TrustProxies(ProxyConfig{[]string{proxy}})
+		if err == nil {
+			t.Errorf("Accepted %q", proxy)
+		}
+	}
+}
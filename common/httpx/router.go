@@ -0,0 +1,197 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type route struct {
+	pattern  string
+	segments []string
+	params   int
+	methods  map[string]http.HandlerFunc
+	handler  http.HandlerFunc
+}
+
+// Router dispatches requests by method and path pattern. Patterns consist of
+// static segments and {name} parameters, e.g. /item/{id}; trailing slashes are
+// ignored. Every route is instrumented with metrics, tracing and the access
+// log under its pattern and recovers from panics.
+type Router struct {
+	routes     []*route
+	middleware []Middleware
+	handler    http.HandlerFunc
+	notFound   http.HandlerFunc
+}
+
+func CreateRouter() *Router {
+	rt := &Router{}
+	rt.handler = rt.dispatch
+	rt.notFound = instrument("unmatched", func(w http.ResponseWriter, r *http.Request) {
+		RespondError(w, r, NewError(http.StatusNotFound, "not_found", "Resource is not found"))
+	})
+	return rt
+}
+
+func split(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// Use wraps the whole router, so the middleware sees the requests before
+// they are matched, e.g. CORS preflight requests.
+func (rt *Router) Use(mw ...Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+	rt.handler = Chain(rt.dispatch, rt.middleware...)
+}
+
+// Handle registers h for the method and the pattern, mw are applied to h only.
+func (rt *Router) Handle(method string, pattern string, h http.HandlerFunc, mw ...Middleware) {
+	segments := split(pattern)
+	key := strings.Join(segments, "/")
+	var found *route
+	for _, r := range rt.routes {
+		if strings.Join(r.segments, "/") == key {
+			found = r
+		}
+	}
+	if found == nil {
+		found = &route{pattern: pattern, segments: segments, methods: make(map[string]http.HandlerFunc)}
+		for _, s := range segments {
+			if isParam(s) {
+				found.params++
+			}
+		}
+		found.handler = instrument(pattern, found.serve)
+		rt.routes = append(rt.routes, found)
+	}
+	if _, ok := found.methods[method]; ok {
+		panic("httpx: " + method + " " + pattern + " is registered twice")
+	}
+	found.methods[method] = Chain(h, mw...)
+}
+
+func (rt *Router) Get(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodGet, pattern, h, mw...)
+}
+
+func (rt *Router) Post(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodPost, pattern, h, mw...)
+}
+
+func (rt *Router) Put(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodPut, pattern, h, mw...)
+}
+
+func (rt *Router) Patch(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodPatch, pattern, h, mw...)
+}
+
+func (rt *Router) Delete(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodDelete, pattern, h, mw...)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler(w, r)
+}
+
+type paramsKey struct{}
+
+func (r *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	params := make(map[string]string, r.params)
+	for i, s := range r.segments {
+		if isParam(s) {
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// dispatch picks the matching route with the fewest parameters, so static
+// segments take precedence.
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	segments := split(r.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if ok && (best == nil || route.params < best.params) {
+			best, bestParams = route, params
+		}
+	}
+	if best == nil {
+		rt.notFound(w, r)
+		return
+	}
+	best.handler(w, r.WithContext(context.WithValue(r.Context(), paramsKey{}, bestParams)))
+}
+
+// serve calls the handler of the request method. HEAD is served by the GET
+// handler unless it is registered separately.
+func (r *route) serve(w http.ResponseWriter, req *http.Request) {
+	h, ok := r.methods[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		h, ok = r.methods[http.MethodGet]
+	}
+	if ok {
+		h(w, req)
+		return
+	}
+	var allowed []string
+	for method := range r.methods {
+		allowed = append(allowed, method)
+	}
+	if _, ok := r.methods[http.MethodGet]; ok {
+		if _, ok := r.methods[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	RespondError(w, req, NewError(http.StatusMethodNotAllowed, "method_not_allowed",
+		"Method "+req.Method+" is not allowed"))
+}
+
+// Param returns the path parameter of the matched route.
+func Param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+func ParamUint(r *http.Request, name string) (uint64, error) {
+	value, err := strconv.ParseUint(Param(r, name), 10, 64)
+	if err != nil {
+		return 0, BadRequest(errors.New("Parameter '" + name + "' should be a non-negative integer"))
+	}
+	return value, nil
+}
+
+// ClientIP returns the address of the connected client without the port,
+// or the address forwarded by a trusted proxy (see TrustProxies).
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,125 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reply writes the name of the handler and the id parameter.
+func reply(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + Param(r, "id")))
+	}
+}
+
+func testRouter() *Router {
+	router := CreateRouter()
+	router.Get("/item/{id}", reply("get item"))
+	router.Put("/item/{id}", reply("put item"))
+	router.Get("/item/new", reply("new item"))
+	router.Post("/items", reply("post items"))
+	router.Delete("/items", reply("delete items"))
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("test")
+	})
+	return router
+}
+
+func TestRouter(t *testing.T) {
+	router := testRouter()
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{"GET", "/item/5", 200, "get item 5", ""},
+		{"PUT", "/item/5/", 200, "put item 5", ""},
+		{"HEAD", "/item/5", 200, "", ""},
+		{"GET", "/item/new", 200, "new item ", ""},
+		{"DELETE", "/item/5", 405, "method_not_allowed", "GET, HEAD, PUT"},
+		{"PUT", "/item/new", 405, "method_not_allowed", "GET, HEAD"},
+		{"GET", "/items", 405, "method_not_allowed", "DELETE, POST"},
+		{"POST", "/items", 200, "post items ", ""},
+		{"GET", "/item", 404, "not_found", ""},
+		{"GET", "/item/5/more", 404, "not_found", ""},
+		{"GET", "/panic", 500, "internal", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s %s: got body %q, want %q", test.method, test.path, w.Body.String(), test.body)
+		}
+		if allow := w.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestRouterRejectsDuplicates(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Registered a route twice")
+		}
+	}()
+	router := testRouter()
+	router.Get("/item/{id}/", reply("again"))
+}
+
+func TestCORS(t *testing.T) {
+	router := testRouter()
+	router.Use(CORS(CORSConfig{Origins: []string{"https://app.example"}, MaxAge: time.Minute}, "Location"))
+	tests := []struct {
+		name    string
+		method  string
+		origin  string
+		request string
+		status  int
+		headers map[string]string
+	}{
+		{"preflight", "OPTIONS", "https://app.example", "PUT", 204, map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example",
+			"Access-Control-Allow-Methods": "PUT",
+			"Access-Control-Max-Age":       "60",
+		}},
+		{"preflight of unknown origin", "OPTIONS", "https://evil.example", "PUT", 405, map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Allow":                       "GET, HEAD, PUT",
+		}},
+		{"request", "GET", "https://app.example", "", 200, map[string]string{
+			"Access-Control-Allow-Origin":   "https://app.example",
+			"Access-Control-Expose-Headers": "X-Request-ID, Location",
+		}},
+		{"request of unknown origin", "GET", "https://evil.example", "", 200, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"options without preflight", "OPTIONS", "https://app.example", "", 405, map[string]string{
+			"Access-Control-Allow-Origin": "https://app.example",
+		}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/item/5", nil)
+		r.Header.Set("Origin", test.origin)
+		if len(test.request) != 0 {
+			r.Header.Set("Access-Control-Request-Method", test.request)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		for name, want := range test.headers {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("%s: got %s %q, want %q", test.name, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("Unknown log level '" + s + "'")
+}
+
+// Fields are added to the log entry as top-level keys.
+type Fields map[string]interface{}
+
+var output = struct {
+	mutex   sync.Mutex
+	writer  io.Writer
+	level   Level
+	service string
+}{writer: os.Stderr, level: LevelInfo}
+
+type Config struct {
+	Level string `env:"LOG_LEVEL" default:"info" oneof:"debug,info,warn,error"`
+}
+
+// Setup makes every entry carry the service name and sets the minimal
+// level. The standard log package is redirected to the logger, so log.Panic
+// in main produces a JSON entry too.
+func Setup(service string, conf Config) error {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	output.mutex.Lock()
+	output.service = service
+	output.level = level
+	output.mutex.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdlogWriter{})
+	return nil
+}
+
+// SetOutput replaces the destination of the entries, stderr by default.
+func SetOutput(w io.Writer) {
+	output.mutex.Lock()
+	output.writer = w
+	output.mutex.Unlock()
+}
+
+type stdlogWriter struct{}
+
+func (stdlogWriter) Write(p []byte) (int, error) {
+	root.log(LevelError, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// Logger writes JSON entries, one per line, with its fields attached.
+type Logger struct {
+	fields Fields
+}
+
+var root = &Logger{}
+
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{merged}
+}
+
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func (l *Logger) log(level Level, msg string, fields []Fields) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	if level < output.level {
+		return
+	}
+	entry := make(Fields, len(l.fields)+4)
+	for k, v := range l.fields {
+		entry[k] = redact(k, value(v))
+	}
+	for _, f := range fields {
+		for k, v := range f {
+			entry[k] = redact(k, value(v))
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	if len(output.service) != 0 {
+		entry["service"] = output.service
+	}
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		bytes, _ = json.Marshal(Fields{"level": LevelError.String(), "msg": "Failed to encode log entry: " + err.Error()})
+	}
+	output.writer.Write(append(bytes, '\n'))
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Fields) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Fields) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Fields) {
+	l.log(LevelError, msg, fields)
+}
+
+// FromContext returns a logger that adds the request id and the trace id
+// of ctx to every entry.
+func FromContext(ctx context.Context) *Logger {
+	fields := Fields{}
+	if id := RequestID(ctx); len(id) != 0 {
+		fields["request_id"] = id
+	}
+	sc := trace.SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		sc = trace.RemoteSpanContextFromContext(ctx)
+	}
+	if sc.IsValid() {
+		fields["trace_id"] = sc.TraceID.String()
+	}
+	if len(fields) == 0 {
+		return root
+	}
+	return root.With(fields)
+}
+
+func With(fields Fields) *Logger {
+	return root.With(fields)
+}
+
+func Debug(msg string, fields ...Fields) {
+	root.log(LevelDebug, msg, fields)
+}
+
+func Info(msg string, fields ...Fields) {
+	root.log(LevelInfo, msg, fields)
+}
+
+func Warn(msg string, fields ...Fields) {
+	root.log(LevelWarn, msg, fields)
+}
+
+func Error(msg string, fields ...Fields) {
+	root.log(LevelError, msg, fields)
+}
@@ -0,0 +1,36 @@
+package logging
+
+import "strings"
+
+const redacted = "[REDACTED]"
+
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"pass_hash":     true,
+	"token":         true,
+	"auth":          true,
+	"authorization": true,
+	"phone":         true,
+	"phone_number":  true,
+	"to":            true,
+	"code":          true,
+	"secret":        true,
+}
+
+// Sensitive reports whether values of the field must not get into logs:
+// passwords, tokens, secrets and phone numbers.
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	return sensitiveKeys[key] ||
+		strings.Contains(key, "password") ||
+		strings.HasSuffix(key, "_token") ||
+		strings.HasSuffix(key, "_secret") ||
+		strings.HasPrefix(key, "phone")
+}
+
+func redact(key string, value interface{}) interface{} {
+	if Sensitive(key) {
+		return redacted
+	}
+	return value
+}
@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDHeader is used in HTTP requests and responses. gRPC metadata and
+// AMQP headers use its lowercase form.
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDKey = "x-request-id"
+
+type requestIDContextKey struct{}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// Carrier is a set of message headers.
+type Carrier interface {
+	Get(key string) string
+	Set(key string, value string)
+}
+
+func Inject(ctx context.Context, c Carrier) {
+	if id := RequestID(ctx); len(id) != 0 {
+		c.Set(requestIDKey, id)
+	}
+}
+
+// Extract returns ctx with the request id from the carrier. A new id is
+// generated if there is none.
+func Extract(ctx context.Context, c Carrier) context.Context {
+	id := c.Get(requestIDKey)
+	if len(id) == 0 {
+		id = NewRequestID()
+	}
+	return WithRequestID(ctx, id)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware takes the request id from the X-Request-ID header or assigns a
+// new one, returns it in the response and logs the request when it is done.
+// Only the route is logged, since paths and queries may contain tokens.
+func Middleware(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if len(id) == 0 || len(id) > 128 {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := WithRequestID(r.Context(), id)
+		rec := &statusRecorder{w, http.StatusOK}
+		start := time.Now()
+		h(rec, r.WithContext(ctx))
+		FromContext(ctx).Info("HTTP request", Fields{
+			"method":      r.Method,
+			"route":       route,
+			"status":      rec.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+	}
+}
+
+// Transport passes the request id of the request context on.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if id := RequestID(r.Context()); len(id) != 0 {
+		r = r.Clone(r.Context())
+		r.Header.Set(RequestIDHeader, id)
+	}
+	return t.Base.RoundTrip(r)
+}
+
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(requestIDKey)) != 0 {
+		id = md.Get(requestIDKey)[0]
+	}
+	if len(id) == 0 {
+		id = NewRequestID()
+	}
+	ctx = WithRequestID(ctx, id)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	FromContext(ctx).Debug("gRPC call", Fields{
+		"method":      info.FullMethod,
+		"status":      status.Code(err).String(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	return resp, err
+}
+
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id := RequestID(ctx); len(id) != 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDKey, id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
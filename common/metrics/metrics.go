@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// All metrics of the services are declared here, so that every service
+// exposes the same names and labels.
+
+var httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_total",
+	Help: "HTTP requests by route, method and status code.",
+}, []string{"route", "method", "code"})
+
+var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "http_request_duration_seconds",
+	Help: "HTTP request latency by route and method.",
+}, []string{"route", "method"})
+
+var grpcServerHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_server_handled_total",
+	Help: "gRPC calls handled by the server by method and status code.",
+}, []string{"method", "code"})
+
+var grpcServerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "grpc_server_handling_seconds",
+	Help: "gRPC call latency on the server by method.",
+}, []string{"method"})
+
+var grpcClientHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_client_handled_total",
+	Help: "gRPC calls made by the client by method and status code.",
+}, []string{"method", "code"})
+
+var grpcClientDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "grpc_client_handling_seconds",
+	Help: "gRPC call latency on the client by method.",
+}, []string{"method"})
+
+var dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "db_query_duration_seconds",
+	Help: "Database query latency by query name.",
+}, []string{"query"})
+
+var mqPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mq_published_total",
+	Help: "Messages published by queue and result (ok or error).",
+}, []string{"queue", "result"})
+
+var mqConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mq_consumed_total",
+	Help: "Messages received from the queue.",
+}, []string{"queue"})
+
+var mqAcked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mq_acked_total",
+	Help: "Messages processed successfully and acknowledged.",
+}, []string{"queue"})
+
+var mqFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mq_failed_total",
+	Help: "Messages that failed processing by action taken (retry or dead).",
+}, []string{"queue", "action"})
+
+var smsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "notifier_sms_sent_total",
+	Help: "SMS sent through the provider by result (ok or error).",
+}, []string{"result"})
+
+var authValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_validations_total",
+	Help: "Access token validations by mode (local or rpc) and result (ok or error).",
+}, []string{"mode", "result"})
+
+var tokensDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_expired_tokens_deleted_total",
+	Help: "Expired tokens, sessions, codes and challenges deleted by the authentication janitor by type.",
+}, []string{"type"})
+
+var janitorRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_janitor_runs_total",
+	Help: "Runs of the authentication janitor by result (ok or error).",
+}, []string{"result"})
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// InstrumentHandler counts the requests of a route and measures their
+// latency. The route should be the registered pattern rather than the
+// request path, so that ids don't blow up the number of series.
+func InstrumentHandler(route string, h http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels), h))
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcServerDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcServerHandled.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	grpcClientDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	grpcClientHandled.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
+
+// ObserveQuery records the duration of a query started at start. It is
+// meant to be deferred: defer metrics.ObserveQuery("get_item", time.Now()).
+func ObserveQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+func Published(queue string, err error) {
+	mqPublished.WithLabelValues(queue, result(err)).Inc()
+}
+
+func Consumed(queue string, count int) {
+	mqConsumed.WithLabelValues(queue).Add(float64(count))
+}
+
+func Acked(queue string, count int) {
+	mqAcked.WithLabelValues(queue).Add(float64(count))
+}
+
+func Failed(queue string, action string) {
+	mqFailed.WithLabelValues(queue, action).Inc()
+}
+
+func Validated(mode string, err error) {
+	authValidations.WithLabelValues(mode, result(err)).Inc()
+}
+
+func TokensDeleted(tokenType string, count int64) {
+	tokensDeleted.WithLabelValues(tokenType).Add(float64(count))
+}
+
+func JanitorRun(err error) {
+	janitorRuns.WithLabelValues(result(err)).Inc()
+}
+
+func SmsSent(err error) {
+	smsSent.WithLabelValues(result(err)).Inc()
+}
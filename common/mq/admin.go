@@ -0,0 +1,212 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/httpx"
+
+	"github.com/streadway/amqp"
+)
+
+type deadMessage struct {
+	Index       int       `json:"index"`
+	Error       string    `json:"error"`
+	Retries     int       `json:"retries"`
+	FailedAt    time.Time `json:"failed_at"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	Body        string    `json:"body,omitempty"`
+}
+
+type getDeadMessagesResponse struct {
+	Queue    string        `json:"queue"`
+	Messages []deadMessage `json:"messages"`
+}
+
+type postDeadMessagesResponse struct {
+	Count int `json:"count"`
+}
+
+func (c *Client) findDeadLetterQueue(name string) (Queue, bool) {
+	for _, q := range c.conf.Topology {
+		if q.Name == name && q.DeadLetter {
+			return q, true
+		}
+	}
+	return Queue{}, false
+}
+
+func parseCount(r *http.Request, def int) (int, error) {
+	value := r.URL.Query().Get("count")
+	if len(value) == 0 {
+		return def, nil
+	}
+	count, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, httpx.BadRequest(errors.New("count should be a positive integer"))
+	}
+	return int(count), nil
+}
+
+// peekDead reads up to limit messages from the dead-letter queue without
+// removing them: they are returned to the queue when the channel closes.
+func (c *Client) peekDead(q Queue, limit int) ([]deadMessage, error) {
+	ch, err := c.channel(false)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	messages := make([]deadMessage, 0)
+	for len(messages) < limit {
+		d, ok, err := ch.Get(q.DeadQueue().Name, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		reason, _ := d.Headers[errorHeader].(string)
+		m := deadMessage{
+			Index:       len(messages),
+			Error:       reason,
+			Retries:     retryCount(d),
+			FailedAt:    d.Timestamp,
+			ContentType: d.ContentType,
+			Size:        len(d.Body),
+		}
+		if !q.HideBody {
+			m.Body = string(d.Body)
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// drainDead removes up to count messages from the head of the dead-letter
+// queue. If replay is set, they are published to the original queue first
+// with their retry counters reset.
+func (c *Client) drainDead(q Queue, count int, replay bool) (int, error) {
+	ch, err := c.channel(false)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	err = ch.Confirm(false)
+	if err != nil {
+		return 0, err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	// Replayed messages may fail again and come back, so only the messages
+	// that are in the queue now are processed.
+	state, err := ch.QueueInspect(q.DeadQueue().Name)
+	if err != nil {
+		return 0, err
+	}
+	if state.Messages < count {
+		count = state.Messages
+	}
+	done := 0
+	for done < count {
+		d, ok, err := ch.Get(q.DeadQueue().Name, false)
+		if err != nil {
+			return done, err
+		}
+		if !ok {
+			break
+		}
+		if replay {
+			msg := q.Publishing(d.ContentType, d.Body)
+			msg.Headers = amqp.Table{}
+			for k, v := range d.Headers {
+				if k != retryCountHeader && k != errorHeader {
+					msg.Headers[k] = v
+				}
+			}
+			err = ch.Publish("", q.Name, false, false, msg)
+			if err != nil {
+				return done, err
+			}
+			// The dead message is acked only when its copy is stored.
+			select {
+			case confirm, ok := <-confirms:
+				if !ok || !confirm.Ack {
+					return done, ErrNotConfirmed
+				}
+			case <-time.After(confirmTimeout):
+				return done, ErrNotConfirmed
+			}
+		}
+		err = d.Ack(false)
+		if err != nil {
+			return done, err
+		}
+		done++
+	}
+	return done, nil
+}
+
+// AdminHandler serves the dead-letter queues of the topology under prefix:
+//
+//	GET  {prefix}/{queue}?count=N          lists the first N dead messages
+//	POST {prefix}/{queue}/replay?count=N   returns them to the queue
+//	POST {prefix}/{queue}/discard?count=N  drops them
+//
+// Without count all messages are processed (up to 100 for GET). Every
+// request goes through authorize first, e.g. auth.Require("manage"). Bodies
+// of queues with HideBody are not shown.
+func (c *Client) AdminHandler(prefix string, authorize httpx.Middleware) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	router := httpx.CreateRouter()
+	router.Use(authorize)
+	router.Get(prefix+"/{queue}", c.deadQueue(func(w http.ResponseWriter, r *http.Request, q Queue) {
+		limit, err := parseCount(r, 100)
+		if err != nil {
+			httpx.RespondError(w, r, err)
+			return
+		}
+		messages, err := c.peekDead(q, limit)
+		if err != nil {
+			httpx.RespondError(w, r, unavailable(err))
+			return
+		}
+		httpx.RespondOK(w, getDeadMessagesResponse{q.Name, messages})
+	}))
+	for _, action := range []string{"replay", "discard"} {
+		replay := action == "replay"
+		router.Post(prefix+"/{queue}/"+action, c.deadQueue(func(w http.ResponseWriter, r *http.Request, q Queue) {
+			count, err := parseCount(r, int(^uint32(0)>>1))
+			if err != nil {
+				httpx.RespondError(w, r, err)
+				return
+			}
+			done, err := c.drainDead(q, count, replay)
+			if err != nil {
+				httpx.RespondError(w, r, unavailable(err))
+				return
+			}
+			httpx.RespondOK(w, postDeadMessagesResponse{done})
+		}))
+	}
+	return router
+}
+
+func (c *Client) deadQueue(h func(http.ResponseWriter, *http.Request, Queue)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := httpx.Param(r, "queue")
+		q, ok := c.findDeadLetterQueue(name)
+		if !ok {
+			httpx.RespondError(w, r, httpx.NotFound(fmt.Errorf("Unknown dead-letter queue '%s'", name)))
+			return
+		}
+		h(w, r, q)
+	}
+}
+
+func unavailable(err error) error {
+	return httpx.NewError(http.StatusServiceUnavailable, "broker_unavailable", err.Error())
+}
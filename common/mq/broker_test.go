@@ -0,0 +1,462 @@
+package mq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker speaks just enough AMQP 0-9-1 for the client, publishers and
+// consumers of this package. Queues outlive connections like durable queues
+// of a real broker, messages are routed through the default exchange and
+// DeadLetterExchange bindings.
+type fakeBroker struct {
+	mutex    sync.Mutex
+	down     bool
+	dials    []time.Time
+	conns    []*fakeConn
+	queues   map[string]*fakeQueue
+	bindings map[string]string
+}
+
+type fakeQueue struct {
+	messages  []fakeMessage
+	consumers []*fakeConsumer
+	next      int
+}
+
+type fakeMessage struct {
+	exchange   string
+	key        string
+	properties []byte
+	body       []byte
+}
+
+type fakeConsumer struct {
+	channel *fakeChannel
+	queue   string
+	tag     string
+}
+
+type fakeConn struct {
+	broker   *fakeBroker
+	conn     net.Conn
+	out      chan []byte
+	done     chan struct{}
+	channels map[uint16]*fakeChannel
+	declared []string
+}
+
+type fakeChannel struct {
+	conn      *fakeConn
+	id        uint16
+	confirm   bool
+	confirmed uint64
+	delivered uint64
+	unacked   map[uint64]fakeMessage
+	consumers map[string]*fakeConsumer
+	publish   *fakeMessage
+	size      uint64
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues:   map[string]*fakeQueue{},
+		bindings: map[string]string{},
+	}
+}
+
+// dial is used as Config.Dial.
+func (b *fakeBroker) dial() (*amqp.Connection, error) {
+	b.mutex.Lock()
+	b.dials = append(b.dials, time.Now())
+	if b.down {
+		b.mutex.Unlock()
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	c := &fakeConn{
+		broker:   b,
+		conn:     server,
+		out:      make(chan []byte, 1024),
+		done:     make(chan struct{}),
+		channels: map[uint16]*fakeChannel{},
+	}
+	b.conns = append(b.conns, c)
+	b.mutex.Unlock()
+	go c.write()
+	go c.serve()
+	return amqp.Open(client, amqp.Config{
+		SASL: []amqp.Authentication{&amqp.PlainAuth{Username: "guest", Password: "guest"}},
+	})
+}
+
+func (b *fakeBroker) setDown(down bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.down = down
+}
+
+// drop breaks all connections as a broker restart would.
+func (b *fakeBroker) drop() {
+	b.mutex.Lock()
+	conns := b.conns
+	b.conns = nil
+	b.mutex.Unlock()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+func (b *fakeBroker) dialTimes() []time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]time.Time(nil), b.dials...)
+}
+
+// declared returns the queues declared on the current connections.
+func (b *fakeBroker) declared() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var queues []string
+	for _, c := range b.conns {
+		queues = append(queues, c.declared...)
+	}
+	return queues
+}
+
+// unacked counts the messages delivered but not acked yet.
+func (b *fakeBroker) unacked() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	count := 0
+	for _, c := range b.conns {
+		for _, ch := range c.channels {
+			count += len(ch.unacked)
+		}
+	}
+	return count
+}
+
+func (b *fakeBroker) queue(name string) *fakeQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// dispatch delivers the pending messages of q round-robin to its
+// consumers. It is called with the mutex held.
+func (b *fakeBroker) dispatch(q *fakeQueue) {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		q.next = (q.next + 1) % len(q.consumers)
+		q.consumers[q.next].deliver(m)
+	}
+}
+
+func (b *fakeBroker) route(m fakeMessage) {
+	name := m.key
+	if m.exchange != "" {
+		name = b.bindings[m.exchange+"/"+m.key]
+	}
+	if name == "" {
+		return
+	}
+	q := b.queue(name)
+	q.messages = append(q.messages, m)
+	b.dispatch(q)
+}
+
+func (s *fakeConsumer) deliver(m fakeMessage) {
+	ch := s.channel
+	ch.delivered++
+	ch.unacked[ch.delivered] = m
+	var args bytes.Buffer
+	writeShortstr(&args, s.tag)
+	binary.Write(&args, binary.BigEndian, ch.delivered)
+	args.WriteByte(0)
+	writeShortstr(&args, m.exchange)
+	writeShortstr(&args, m.key)
+	ch.conn.method(ch.id, 60, 60, args.Bytes())
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint16(60))
+	binary.Write(&header, binary.BigEndian, uint16(0))
+	binary.Write(&header, binary.BigEndian, uint64(len(m.body)))
+	header.Write(m.properties)
+	ch.conn.send(2, ch.id, header.Bytes())
+	ch.conn.send(3, ch.id, m.body)
+}
+
+func (c *fakeConn) send(kind byte, channel uint16, payload []byte) {
+	var frame bytes.Buffer
+	frame.WriteByte(kind)
+	binary.Write(&frame, binary.BigEndian, channel)
+	binary.Write(&frame, binary.BigEndian, uint32(len(payload)))
+	frame.Write(payload)
+	frame.WriteByte(0xce)
+	select {
+	case c.out <- frame.Bytes():
+	case <-c.done:
+	}
+}
+
+func (c *fakeConn) method(channel uint16, class, method uint16, args []byte) {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, class)
+	binary.Write(&payload, binary.BigEndian, method)
+	payload.Write(args)
+	c.send(1, channel, payload.Bytes())
+}
+
+func (c *fakeConn) write() {
+	for {
+		select {
+		case frame := <-c.out:
+			_, err := c.conn.Write(frame)
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *fakeConn) read() (kind byte, channel uint16, payload []byte, err error) {
+	header := make([]byte, 7)
+	_, err = io.ReadFull(c.conn, header)
+	if err != nil {
+		return
+	}
+	kind = header[0]
+	channel = binary.BigEndian.Uint16(header[1:3])
+	payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	_, err = io.ReadFull(c.conn, payload)
+	payload = payload[:len(payload)-1]
+	return
+}
+
+func (c *fakeConn) serve() {
+	defer c.close()
+	protocol := make([]byte, 8)
+	_, err := io.ReadFull(c.conn, protocol)
+	if err != nil {
+		return
+	}
+	var start bytes.Buffer
+	start.Write([]byte{0, 9})
+	binary.Write(&start, binary.BigEndian, uint32(0))
+	writeLongstr(&start, "PLAIN")
+	writeLongstr(&start, "en_US")
+	c.method(0, 10, 10, start.Bytes())
+	for {
+		kind, channel, payload, err := c.read()
+		if err != nil {
+			return
+		}
+		if !c.handle(kind, channel, payload) {
+			return
+		}
+	}
+}
+
+// close requeues the unacked messages of all channels.
+func (c *fakeConn) close() {
+	c.conn.Close()
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+	for _, ch := range c.channels {
+		ch.close()
+	}
+	close(c.done)
+}
+
+func (ch *fakeChannel) close() {
+	b := ch.conn.broker
+	for _, s := range ch.consumers {
+		b.cancel(s)
+	}
+	for _, m := range ch.unacked {
+		b.route(m)
+	}
+	delete(ch.conn.channels, ch.id)
+}
+
+func (b *fakeBroker) cancel(s *fakeConsumer) {
+	q := b.queue(s.queue)
+	for i, other := range q.consumers {
+		if other == s {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+	delete(s.channel.consumers, s.tag)
+}
+
+func (c *fakeConn) handle(kind byte, channel uint16, payload []byte) bool {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := c.channels[channel]
+	switch kind {
+	case 2:
+		if ch == nil || ch.publish == nil {
+			return false
+		}
+		ch.size = binary.BigEndian.Uint64(payload[4:12])
+		ch.publish.properties = payload[12:]
+		if ch.size == 0 {
+			ch.published()
+		}
+		return true
+	case 3:
+		if ch == nil || ch.publish == nil {
+			return false
+		}
+		ch.publish.body = append(ch.publish.body, payload...)
+		if uint64(len(ch.publish.body)) >= ch.size {
+			ch.published()
+		}
+		return true
+	case 8:
+		return true
+	}
+	r := bytes.NewReader(payload[4:])
+	class := uint32(binary.BigEndian.Uint16(payload[0:2]))
+	method := uint32(binary.BigEndian.Uint16(payload[2:4]))
+	switch class<<16 | method {
+	case 10<<16 | 11: // connection.start-ok
+		var tune bytes.Buffer
+		binary.Write(&tune, binary.BigEndian, uint16(0))
+		binary.Write(&tune, binary.BigEndian, uint32(131072))
+		binary.Write(&tune, binary.BigEndian, uint16(0))
+		c.method(0, 10, 30, tune.Bytes())
+	case 10<<16 | 31: // connection.tune-ok
+	case 10<<16 | 40: // connection.open
+		c.method(0, 10, 41, []byte{0})
+	case 10<<16 | 50: // connection.close
+		c.method(0, 10, 51, nil)
+		return false
+	case 10<<16 | 51: // connection.close-ok
+		return false
+	case 20<<16 | 10: // channel.open
+		c.channels[channel] = &fakeChannel{
+			conn:      c,
+			id:        channel,
+			unacked:   map[uint64]fakeMessage{},
+			consumers: map[string]*fakeConsumer{},
+		}
+		c.method(channel, 20, 11, []byte{0, 0, 0, 0})
+	case 20<<16 | 40: // channel.close
+		if ch != nil {
+			ch.close()
+		}
+		c.method(channel, 20, 41, nil)
+	case 20<<16 | 41: // channel.close-ok
+	case 40<<16 | 10: // exchange.declare
+		c.method(channel, 40, 11, nil)
+	case 50<<16 | 10: // queue.declare
+		r.Seek(2, io.SeekCurrent)
+		name := readShortstr(r)
+		c.declared = append(c.declared, name)
+		b.queue(name)
+		var ok bytes.Buffer
+		writeShortstr(&ok, name)
+		binary.Write(&ok, binary.BigEndian, uint32(len(b.queue(name).messages)))
+		binary.Write(&ok, binary.BigEndian, uint32(len(b.queue(name).consumers)))
+		c.method(channel, 50, 11, ok.Bytes())
+	case 50<<16 | 20: // queue.bind
+		r.Seek(2, io.SeekCurrent)
+		queue := readShortstr(r)
+		exchange := readShortstr(r)
+		key := readShortstr(r)
+		b.bindings[exchange+"/"+key] = queue
+		c.method(channel, 50, 21, nil)
+	case 60<<16 | 10: // basic.qos
+		c.method(channel, 60, 11, nil)
+	case 60<<16 | 20: // basic.consume
+		r.Seek(2, io.SeekCurrent)
+		queue := readShortstr(r)
+		tag := readShortstr(r)
+		s := &fakeConsumer{channel: ch, queue: queue, tag: tag}
+		ch.consumers[tag] = s
+		var ok bytes.Buffer
+		writeShortstr(&ok, tag)
+		c.method(channel, 60, 21, ok.Bytes())
+		q := b.queue(queue)
+		q.consumers = append(q.consumers, s)
+		b.dispatch(q)
+	case 60<<16 | 30: // basic.cancel
+		tag := readShortstr(r)
+		if s, ok := ch.consumers[tag]; ok {
+			b.cancel(s)
+		}
+		var ok bytes.Buffer
+		writeShortstr(&ok, tag)
+		c.method(channel, 60, 31, ok.Bytes())
+	case 60<<16 | 40: // basic.publish
+		r.Seek(2, io.SeekCurrent)
+		exchange := readShortstr(r)
+		key := readShortstr(r)
+		ch.publish = &fakeMessage{exchange: exchange, key: key}
+	case 60<<16 | 80: // basic.ack
+		var tag uint64
+		binary.Read(r, binary.BigEndian, &tag)
+		delete(ch.unacked, tag)
+	case 60<<16 | 90, 60<<16 | 120: // basic.reject, basic.nack
+		var tag uint64
+		binary.Read(r, binary.BigEndian, &tag)
+		m, ok := ch.unacked[tag]
+		if ok {
+			delete(ch.unacked, tag)
+			b.route(m)
+		}
+	case 85<<16 | 10: // confirm.select
+		ch.confirm = true
+		c.method(channel, 85, 11, nil)
+	default:
+		return false
+	}
+	return true
+}
+
+func (ch *fakeChannel) published() {
+	m := *ch.publish
+	ch.publish = nil
+	ch.conn.broker.route(m)
+	if ch.confirm {
+		ch.confirmed++
+		var ack bytes.Buffer
+		binary.Write(&ack, binary.BigEndian, ch.confirmed)
+		ack.WriteByte(0)
+		ch.conn.method(ch.id, 60, 80, ack.Bytes())
+	}
+}
+
+func readShortstr(r *bytes.Reader) string {
+	n, _ := r.ReadByte()
+	s := make([]byte, n)
+	io.ReadFull(r, s)
+	return string(s)
+}
+
+func writeShortstr(w *bytes.Buffer, s string) {
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+func writeLongstr(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint32(len(s)))
+	w.WriteString(s)
+}
@@ -0,0 +1,171 @@
+package mq
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"common/logging"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrNotConnected = errors.New("Message queue is not connected")
+
+const minReconnectDelay = time.Second
+const maxReconnectDelay = 30 * time.Second
+
+// Client keeps a connection to the broker. When the connection is lost it
+// reconnects with exponential backoff and declares the topology again;
+// publishers and consumers created by the client reopen their channels on
+// the new connection.
+type Client struct {
+	conf       Config
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	connection *amqp.Connection
+	closed     bool
+}
+
+func (c *Client) dial() (*amqp.Connection, error) {
+	var connection *amqp.Connection
+	var err error
+	if c.conf.Dial != nil {
+		connection, err = c.conf.Dial()
+	} else {
+		connection, err = amqp.Dial(c.conf.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = Declare(connection, c.conf.Migration, c.conf.Topology...)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+func CreateClient(conf Config) (*Client, error) {
+	conf.Topology = conf.topology()
+	c := &Client{conf: conf}
+	c.cond = sync.NewCond(&c.mutex)
+	connection, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.connection = connection
+	go c.watch(connection)
+	return c, nil
+}
+
+func (c *Client) watch(connection *amqp.Connection) {
+	for {
+		err := <-connection.NotifyClose(make(chan *amqp.Error, 1))
+		c.mutex.Lock()
+		c.connection = nil
+		closed := c.closed
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		logging.Warn("Message queue connection lost", logging.Fields{"error": err})
+		connection = c.reconnect()
+		if connection == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) reconnect() *amqp.Connection {
+	delay := minReconnectDelay
+	for {
+		time.Sleep(delay)
+		connection, err := c.dial()
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			if connection != nil {
+				connection.Close()
+			}
+			return nil
+		}
+		if err == nil {
+			c.connection = connection
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+			logging.Info("Message queue connection restored")
+			return connection
+		}
+		c.mutex.Unlock()
+		logging.Warn("Message queue reconnection failed", logging.Fields{"error": err, "delay": delay})
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// connectionLost tells whether err comes from a broken connection rather
+// than from the broker refusing a request. A transport error means the
+// connection is broken even if it hasn't been shut down yet.
+func connectionLost(err error) bool {
+	_, protocol := err.(*amqp.Error)
+	return err == amqp.ErrClosed || err != nil && !protocol
+}
+
+func (c *Client) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// channel opens a new channel. If wait is set and the connection is down,
+// it blocks until the client reconnects, otherwise ErrNotConnected is
+// returned right away. amqp.ErrClosed means the client has been closed.
+func (c *Client) channel(wait bool) (*amqp.Channel, error) {
+	var failed *amqp.Connection
+	c.mutex.Lock()
+	for {
+		for !c.closed && (c.connection == nil || c.connection == failed) {
+			if !wait {
+				c.mutex.Unlock()
+				return nil, ErrNotConnected
+			}
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return nil, amqp.ErrClosed
+		}
+		connection := c.connection
+		c.mutex.Unlock()
+		ch, err := connection.Channel()
+		if !connectionLost(err) {
+			return ch, err
+		}
+		failed = connection
+		c.mutex.Lock()
+	}
+}
+
+// Ping checks that a channel can be opened on the current connection.
+func (c *Client) Ping() error {
+	ch, err := c.channel(false)
+	if err != nil {
+		return err
+	}
+	return ch.Close()
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	connection := c.connection
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	if connection == nil {
+		return nil
+	}
+	return connection.Close()
+}
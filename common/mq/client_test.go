@@ -0,0 +1,109 @@
+package mq
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, received <-chan SmsMessage) SmsMessage {
+	select {
+	case m := <-received:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message wasn't consumed")
+		return SmsMessage{}
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	broker := newFakeBroker()
+	client, err := CreateClient(Config{
+		Prefetch:    1,
+		Concurrency: 1,
+		Migration:   "fail",
+		Topology:    []Queue{SmsMessages},
+		Dial:        broker.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	publisher, err := client.NewSmsPublisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan SmsMessage, 1)
+	consumer, err := client.ConsumeSms(client.Options(), func(ctx context.Context, m SmsMessage) error {
+		received <- m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop(context.Background())
+	err = publisher.Send(context.Background(), SmsMessage{To: "1", Message: "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, received); m.Message != "before" {
+		t.Fatalf("Got %q, want %q", m.Message, "before")
+	}
+	for broker.unacked() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	broker.setDown(true)
+	dropped := time.Now()
+	broker.drop()
+	time.Sleep(100 * time.Millisecond)
+	err = publisher.Send(context.Background(), SmsMessage{To: "1", Message: "lost"})
+	if err == nil {
+		t.Fatal("Publish succeeded without a connection")
+	}
+	if err := client.Ping(); err != ErrNotConnected {
+		t.Fatalf("Ping returned %v, want ErrNotConnected", err)
+	}
+	// The first attempt after a second fails, the next one comes after
+	// twice the delay.
+	time.Sleep(1500 * time.Millisecond)
+	broker.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Ping() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Client didn't reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	dials := broker.dialTimes()
+	if len(dials) != 3 {
+		t.Fatalf("Got %d dials, want 3", len(dials))
+	}
+	if d := dials[1].Sub(dropped); d < minReconnectDelay {
+		t.Errorf("Reconnected %v after the connection was lost, want at least %v", d, minReconnectDelay)
+	}
+	if d := dials[2].Sub(dials[1]); d < 2*minReconnectDelay {
+		t.Errorf("Retried after %v, want at least %v", d, 2*minReconnectDelay)
+	}
+
+	declared := broker.declared()
+	sort.Strings(declared)
+	want := []string{"sms_messages", "sms_messages.dead", "sms_messages.retry"}
+	if len(declared) != len(want) {
+		t.Fatalf("Declared %v, want %v", declared, want)
+	}
+	for i := range want {
+		if declared[i] != want[i] {
+			t.Fatalf("Declared %v, want %v", declared, want)
+		}
+	}
+
+	err = publisher.Send(context.Background(), SmsMessage{To: "1", Message: "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, received); m.Message != "after" {
+		t.Fatalf("Got %q, want %q", m.Message, "after")
+	}
+}
@@ -0,0 +1,38 @@
+package mq
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type Config struct {
+	URL         string `env:"MESSAGE_QUEUE_URL" required:"true" secret:"true"`
+	Prefetch    int    `env:"MQ_PREFETCH" default:"1" min:"0"`
+	Concurrency int    `env:"MQ_CONCURRENCY" default:"1" min:"1"`
+	// MaxRetries and RetryDelay override the retry policy of all queues of
+	// the topology when set.
+	MaxRetries *int           `env:"MQ_MAX_RETRIES" min:"0"`
+	RetryDelay *time.Duration `env:"MQ_RETRY_DELAY" min:"0s"`
+	// Migration is "recreate" to migrate queues declared with different
+	// properties, otherwise such queues fail the declaration.
+	Migration string `env:"MQ_QUEUE_MIGRATION" default:"fail" oneof:"fail,recreate"`
+	// Topology is filled by services with the queues they work with.
+	Topology []Queue
+	// Dial replaces amqp.Dial(URL), e.g. to connect to an in-process broker.
+	Dial func() (*amqp.Connection, error)
+}
+
+func (c *Config) topology() []Queue {
+	queues := make([]Queue, len(c.Topology))
+	for i, q := range c.Topology {
+		if c.MaxRetries != nil {
+			q.MaxRetries = *c.MaxRetries
+		}
+		if c.RetryDelay != nil {
+			q.RetryDelay = *c.RetryDelay
+		}
+		queues[i] = q
+	}
+	return queues
+}
@@ -0,0 +1,363 @@
+package mq
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"common/logging"
+	"common/metrics"
+
+	"github.com/streadway/amqp"
+)
+
+type ConsumerOptions struct {
+	Prefetch    int
+	Concurrency int
+	// With MergeMessages > 1 every worker collects up to MergeMessages
+	// messages, waiting at most MergeWait for the next one, and passes them
+	// to the handler at once. Prefetch should be at least
+	// Concurrency * MergeMessages, otherwise workers wait for acks that
+	// never come until MergeWait expires.
+	MergeMessages int
+	MergeWait     time.Duration
+}
+
+// Options returns consumer options with the defaults from the config.
+func (c *Client) Options() ConsumerOptions {
+	return ConsumerOptions{
+		Prefetch:    c.conf.Prefetch,
+		Concurrency: c.conf.Concurrency,
+	}
+}
+
+type Delivery struct {
+	amqp.Delivery
+	codec Codec
+}
+
+func (d *Delivery) Decode(v interface{}) error {
+	return d.codec.Unmarshal(d.Body, v)
+}
+
+// Handler gets a context that continues the trace of the message.
+type Handler func(ctx context.Context, d Delivery) error
+
+// BatchHandler processes several messages at once, a nil result acks all
+// of them.
+type BatchHandler func(ctx context.Context, ds []Delivery) error
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks a handler error that retrying can't fix, e.g. a malformed
+// message. Such messages go to the dead-letter queue right away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Consumer runs the handler for every message of the queue on
+// opts.Concurrency goroutines. A message is acked after the handler
+// succeeds. A failed message is retried according to the queue retry policy
+// and then moved to the dead-letter queue. If the queue has no dead-letter
+// queue, the first such failure stops the consumer and is returned by Wait,
+// the failed message stays unacked and is redelivered. If the connection is
+// lost, consumption resumes after the client reconnects.
+type Consumer struct {
+	client   *Client
+	queue    Queue
+	codec    Codec
+	opts     ConsumerOptions
+	handler  BatchHandler
+	retry    *Publisher
+	dead     *Publisher
+	tag      string
+	mutex    sync.Mutex
+	channel  *amqp.Channel
+	stopping bool
+	err      error
+	done     chan struct{}
+}
+
+func generateTag(queue string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%x", queue, b)
+}
+
+func (c *Client) Consume(q Queue, codec Codec, opts ConsumerOptions, handler Handler) (*Consumer, error) {
+	opts.MergeMessages = 1
+	return c.ConsumeMerged(q, codec, opts, func(ctx context.Context, ds []Delivery) error {
+		return handler(ctx, ds[0])
+	})
+}
+
+// ConsumeMerged works like Consume, but passes up to opts.MergeMessages
+// messages to the handler at once. If the handler fails on several
+// messages, they are handled again one by one, so that only the failing
+// ones are retried.
+func (c *Client) ConsumeMerged(q Queue, codec Codec, opts ConsumerOptions, handler BatchHandler) (*Consumer, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.MergeMessages < 1 {
+		opts.MergeMessages = 1
+	}
+	// The retry policy may be overridden in the config.
+	for _, tq := range c.conf.Topology {
+		if tq.Name == q.Name {
+			q = tq
+		}
+	}
+	consumer := &Consumer{
+		client:  c,
+		queue:   q,
+		codec:   codec,
+		opts:    opts,
+		handler: handler,
+		// Failed messages are acked only after the broker confirms their
+		// copies, the channels are opened with the first failure.
+		retry: &Publisher{client: c, queue: q.RetryQueue()},
+		dead:  &Publisher{client: c, exchange: DeadLetterExchange, queue: q},
+		tag:   generateTag(q.Name),
+		done:  make(chan struct{}),
+	}
+	msgs, err := consumer.open()
+	if err != nil {
+		return nil, err
+	}
+	go consumer.run(msgs)
+	return consumer, nil
+}
+
+func (c *Consumer) open() (<-chan amqp.Delivery, error) {
+	ch, err := c.client.channel(true)
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Qos(c.opts.Prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	msgs, err := ch.Consume(
+		c.queue.Name, // queue
+		c.tag,        // consumer
+		false,        // auto-ack
+		false,        // exclusive
+		false,        // no-local
+		false,        // no-wait
+		nil,          // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.channel = ch
+	c.mutex.Unlock()
+	return msgs, nil
+}
+
+func (c *Consumer) failed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err != nil
+}
+
+func (c *Consumer) stopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopping
+}
+
+func (c *Consumer) closeChannel() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.channel.Close()
+}
+
+func (c *Consumer) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.channel.Close()
+	}
+}
+
+func (c *Consumer) run(msgs <-chan amqp.Delivery) {
+	defer close(c.done)
+	defer c.retry.Close()
+	defer c.dead.Close()
+	for {
+		var wg sync.WaitGroup
+		wg.Add(c.opts.Concurrency)
+		for i := 0; i < c.opts.Concurrency; i++ {
+			go c.work(msgs, &wg)
+		}
+		wg.Wait()
+		if c.failed() || c.stopped() {
+			c.closeChannel()
+			return
+		}
+		var err error
+		msgs, err = c.open()
+		for connectionLost(err) && !c.client.isClosed() {
+			msgs, err = c.open()
+		}
+		if err != nil {
+			// The client is closed or the queue can't be consumed anymore.
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// collect reads the next group of messages to handle together. It returns
+// nothing when msgs is closed.
+func (c *Consumer) collect(msgs <-chan amqp.Delivery) []amqp.Delivery {
+	m, ok := <-msgs
+	if !ok {
+		return nil
+	}
+	group := []amqp.Delivery{m}
+	if c.opts.MergeMessages == 1 {
+		return group
+	}
+	timeout := time.NewTimer(c.opts.MergeWait)
+	defer timeout.Stop()
+	for len(group) < c.opts.MergeMessages {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return group
+			}
+			group = append(group, m)
+		case <-timeout.C:
+			return group
+		}
+	}
+	return group
+}
+
+func (c *Consumer) handle(group []amqp.Delivery) error {
+	ds := make([]Delivery, len(group))
+	for i, m := range group {
+		ds[i] = Delivery{m, c.codec}
+	}
+	ctx, span := startProcess(c.queue, ds)
+	herr := c.handler(ctx, ds)
+	if herr != nil {
+		span.RecordError(ctx, herr)
+	}
+	span.End()
+	if herr != nil && len(group) == 1 {
+		return c.reject(group[0], herr)
+	}
+	if herr != nil {
+		for _, m := range group {
+			err := c.handle([]amqp.Delivery{m})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, m := range group {
+		err := m.Ack(false)
+		if err != nil {
+			return err
+		}
+	}
+	metrics.Acked(c.queue.Name, len(group))
+	return nil
+}
+
+func (c *Consumer) work(msgs <-chan amqp.Delivery, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		group := c.collect(msgs)
+		if group == nil {
+			return
+		}
+		metrics.Consumed(c.queue.Name, len(group))
+		err := c.handle(group)
+		if connectionLost(err) {
+			// The messages will be redelivered on the new channel.
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Consumer) reject(m amqp.Delivery, reason error) error {
+	retries := retryCount(m)
+	ctx := logging.Extract(context.Background(), tableCarrier(m.Headers))
+	logging.FromContext(ctx).Warn("Failed to handle message", logging.Fields{
+		"queue": c.queue.Name,
+		"retry": retries,
+		"error": reason,
+	})
+	_, permanent := reason.(permanentError)
+	if !permanent && retries < c.queue.MaxRetries {
+		err := c.retry.publish(c.queue.RetryPublishing(m, retries+1))
+		if err != nil {
+			return err
+		}
+		metrics.Failed(c.queue.Name, "retry")
+		return m.Ack(false)
+	}
+	if !c.queue.DeadLetter {
+		return reason
+	}
+	err := c.dead.publish(c.queue.DeadPublishing(m, reason))
+	if err != nil {
+		return err
+	}
+	metrics.Failed(c.queue.Name, "dead")
+	return m.Ack(false)
+}
+
+// Stop cancels the subscription and waits until the messages that have
+// already been delivered are handled and acked. If ctx expires first, the
+// channel is closed without waiting for the handlers, and unacked messages
+// are returned to the queue.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.mutex.Lock()
+	c.stopping = true
+	ch := c.channel
+	c.mutex.Unlock()
+	ch.Cancel(c.tag, false)
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// Done is closed when the consumer stops.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the consumer stops and returns the reason, nil if it
+// was stopped by Stop.
+func (c *Consumer) Wait() error {
+	<-c.done
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
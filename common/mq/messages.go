@@ -0,0 +1,81 @@
+package mq
+
+import (
+	"context"
+
+	"common/dbclient"
+)
+
+type SmsMessage struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type SmsPublisher struct {
+	publisher *Publisher
+}
+
+func (c *Client) NewSmsPublisher() (SmsPublisher, error) {
+	p, err := c.NewPublisher(SmsMessages, JSON)
+	return SmsPublisher{p}, err
+}
+
+func (p SmsPublisher) Send(ctx context.Context, message SmsMessage) error {
+	return p.publisher.Publish(ctx, message)
+}
+
+func (c *Client) ConsumeSms(opts ConsumerOptions, handler func(context.Context, SmsMessage) error) (*Consumer, error) {
+	return c.Consume(SmsMessages, JSON, opts, func(ctx context.Context, d Delivery) error {
+		var message SmsMessage
+		err := d.Decode(&message)
+		if err != nil {
+			return Permanent(err)
+		}
+		return handler(ctx, message)
+	})
+}
+
+// ImportBatch carries an id assigned by the publisher, so that a consumer
+// can recognize redelivered batches.
+type ImportBatch = dbclient.ItemBatch
+
+type ImportBatchPublisher struct {
+	publisher *Publisher
+}
+
+func (c *Client) NewImportBatchPublisher() (ImportBatchPublisher, error) {
+	p, err := c.NewPublisher(BatchImport, JSON)
+	return ImportBatchPublisher{p}, err
+}
+
+func (p ImportBatchPublisher) Send(ctx context.Context, batch ImportBatch) error {
+	return p.publisher.Publish(ctx, batch)
+}
+
+func decodeImportBatch(d Delivery) (ImportBatch, error) {
+	var batch ImportBatch
+	err := d.Decode(&batch)
+	if err == nil {
+		return batch, nil
+	}
+	// Messages published before batches got ids are plain arrays of items.
+	err = d.Decode(&batch.Items)
+	return batch, err
+}
+
+// ConsumeImportBatches passes the batches of every message to the handler.
+// If opts.MergeMessages > 1, batches of several messages are passed
+// together.
+func (c *Client) ConsumeImportBatches(opts ConsumerOptions, handler func(context.Context, []ImportBatch) error) (*Consumer, error) {
+	return c.ConsumeMerged(BatchImport, JSON, opts, func(ctx context.Context, ds []Delivery) error {
+		batches := make([]ImportBatch, 0, len(ds))
+		for _, d := range ds {
+			batch, err := decodeImportBatch(d)
+			if err != nil {
+				return Permanent(err)
+			}
+			batches = append(batches, batch)
+		}
+		return handler(ctx, batches)
+	})
+}
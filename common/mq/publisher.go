@@ -0,0 +1,136 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"common/metrics"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrNotConfirmed = errors.New("Broker didn't confirm the message")
+
+const confirmTimeout = 30 * time.Second
+
+// Publisher sends messages to a single queue. Every Publish waits until the
+// broker confirms the message, so a nil error means the message is stored.
+// While the client is reconnecting Publish fails with ErrNotConnected.
+type Publisher struct {
+	client    *Client
+	exchange  string
+	queue     Queue
+	codec     Codec
+	mutex     sync.Mutex
+	channel   *amqp.Channel
+	confirms  chan amqp.Confirmation
+	published uint64
+}
+
+func (c *Client) NewPublisher(q Queue, codec Codec) (*Publisher, error) {
+	p := &Publisher{
+		client: c,
+		queue:  q,
+		codec:  codec,
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Publisher) open() error {
+	ch, err := p.client.channel(false)
+	if err != nil {
+		return err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	p.channel = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.published = 0
+	return nil
+}
+
+func (p *Publisher) drop() {
+	if p.channel != nil {
+		p.channel.Close()
+		p.channel = nil
+	}
+}
+
+// Publish sends v with the trace context of ctx in the headers.
+func (p *Publisher) Publish(ctx context.Context, v interface{}) error {
+	body, err := p.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := p.queue.Publishing(p.codec.ContentType(), body)
+	_, span := startPublish(ctx, p.queue, &msg)
+	err = p.publish(msg)
+	if err != nil {
+		span.RecordError(ctx, err)
+	}
+	span.End()
+	metrics.Published(p.queue.Name, err)
+	return err
+}
+
+func (p *Publisher) publish(msg amqp.Publishing) error {
+	var err error
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.channel == nil {
+		err = p.open()
+		if err != nil {
+			return err
+		}
+	}
+	err = p.channel.Publish(
+		p.exchange,   // exchange
+		p.queue.Name, // routing key
+		false,        // mandatory
+		false,        // immediate
+		msg)
+	if err != nil {
+		p.drop()
+		return err
+	}
+	p.published++
+	timeout := time.After(confirmTimeout)
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				p.drop()
+				return ErrNotConfirmed
+			}
+			// Late confirmations of messages that already timed out.
+			if confirm.DeliveryTag < p.published {
+				continue
+			}
+			if !confirm.Ack {
+				return ErrNotConfirmed
+			}
+			return nil
+		case <-timeout:
+			p.drop()
+			return ErrNotConfirmed
+		}
+	}
+}
+
+func (p *Publisher) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.drop()
+	return nil
+}
@@ -0,0 +1,275 @@
+package mq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"common/logging"
+
+	"github.com/streadway/amqp"
+)
+
+const DeadLetterExchange = "dead_letters"
+
+const retryCountHeader = "x-retry-count"
+const errorHeader = "x-error"
+
+type Queue struct {
+	Name    string
+	Durable bool
+	Args    amqp.Table
+	// A message whose handler fails is retried MaxRetries times with
+	// RetryDelay between attempts through the "<name>.retry" queue.
+	MaxRetries int
+	RetryDelay time.Duration
+	// Messages that are still failing after all retries are routed to the
+	// "<name>.dead" queue through DeadLetterExchange.
+	DeadLetter bool
+	// HideBody keeps the bodies out of the admin API, e.g. when they carry
+	// confirmation codes.
+	HideBody bool
+}
+
+var SmsMessages = Queue{
+	Name:       "sms_messages",
+	Durable:    true,
+	MaxRetries: 5,
+	RetryDelay: 10 * time.Second,
+	DeadLetter: true,
+	HideBody:   true,
+}
+
+var BatchImport = Queue{
+	Name:       "batch_import",
+	Durable:    true,
+	MaxRetries: 5,
+	RetryDelay: 30 * time.Second,
+	DeadLetter: true,
+}
+
+func (q Queue) RetryQueue() Queue {
+	return Queue{
+		Name:    q.Name + ".retry",
+		Durable: q.Durable,
+		Args: amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": q.Name,
+		},
+	}
+}
+
+func (q Queue) DeadQueue() Queue {
+	return Queue{
+		Name:    q.Name + ".dead",
+		Durable: q.Durable,
+	}
+}
+
+// RetryPublishing prepares a message for the retry queue. It comes back to
+// the queue after RetryDelay, when its per-message TTL expires.
+func (q Queue) RetryPublishing(d amqp.Delivery, retries int) amqp.Publishing {
+	msg := q.Publishing(d.ContentType, d.Body)
+	msg.Headers = amqp.Table{}
+	for k, v := range d.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[retryCountHeader] = int32(retries)
+	msg.Expiration = strconv.FormatInt(int64(q.RetryDelay/time.Millisecond), 10)
+	return msg
+}
+
+// DeadPublishing prepares a message for the dead-letter queue keeping the
+// reason of the last failure.
+func (q Queue) DeadPublishing(d amqp.Delivery, reason error) amqp.Publishing {
+	msg := q.Publishing(d.ContentType, d.Body)
+	msg.Headers = amqp.Table{}
+	for k, v := range d.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[errorHeader] = reason.Error()
+	msg.Timestamp = time.Now()
+	return msg
+}
+
+func retryCount(d amqp.Delivery) int {
+	switch v := d.Headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// Publishing wraps the body into a message that survives a broker restart
+// whenever the queue itself does.
+func (q Queue) Publishing(contentType string, body []byte) amqp.Publishing {
+	msg := amqp.Publishing{
+		ContentType: contentType,
+		Body:        body,
+	}
+	if q.Durable {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	return msg
+}
+
+func declareAll(ch *amqp.Channel, q Queue) error {
+	err := declare(ch, q)
+	if err != nil {
+		return err
+	}
+	if q.MaxRetries > 0 {
+		err = declare(ch, q.RetryQueue())
+		if err != nil {
+			return err
+		}
+	}
+	if q.DeadLetter {
+		err = ch.ExchangeDeclare(
+			DeadLetterExchange, // name
+			"direct",           // kind
+			true,               // durable
+			false,              // delete when unused
+			false,              // internal
+			false,              // no-wait
+			nil,                // arguments
+		)
+		if err != nil {
+			return err
+		}
+		dead := q.DeadQueue()
+		err = declare(ch, dead)
+		if err != nil {
+			return err
+		}
+		err = ch.QueueBind(dead.Name, q.Name, DeadLetterExchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func declare(ch *amqp.Channel, q Queue) error {
+	_, err := ch.QueueDeclare(
+		q.Name,    // name
+		q.Durable, // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		q.Args,    // arguments
+	)
+	return err
+}
+
+func isPreconditionFailed(err error) bool {
+	aerr, ok := err.(*amqp.Error)
+	return ok && aerr.Code == amqp.PreconditionFailed
+}
+
+// Declare creates all queues on a dedicated channel. A queue that already
+// exists with other properties (e.g. non-durable queues created by older
+// versions) is a fatal error unless migration is "recreate"
+// (MQ_QUEUE_MIGRATION in Config), in which case the queue is recreated and
+// its pending messages are kept.
+func Declare(conn *amqp.Connection, migration string, queues ...Queue) error {
+	for _, q := range queues {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		err = declareAll(ch, q)
+		if err == nil {
+			ch.Close()
+			continue
+		}
+		if !isPreconditionFailed(err) {
+			return err
+		}
+		if migration != "recreate" {
+			return fmt.Errorf("Queue '%s' exists with different properties, "+
+				"set MQ_QUEUE_MIGRATION=recreate to migrate it: %v", q.Name, err)
+		}
+		err = recreate(conn, q)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate queue '%s': %v", q.Name, err)
+		}
+		ch, err = conn.Channel()
+		if err != nil {
+			return err
+		}
+		err = declareAll(ch, q)
+		ch.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recreate moves pending messages of the existing queue to a temporary
+// durable queue, replaces the queue with the new definition and moves the
+// messages back. Messages published while the queue is being replaced are
+// lost, so it should be done while publishers are idle.
+func recreate(conn *amqp.Connection, q Queue) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	tmp := Queue{Name: q.Name + ".migration", Durable: true}
+	err = declare(ch, tmp)
+	if err != nil {
+		return err
+	}
+	moved, err := move(ch, q.Name, tmp)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDelete(q.Name, false, false, false)
+	if err != nil {
+		return err
+	}
+	err = declare(ch, q)
+	if err != nil {
+		return err
+	}
+	_, err = move(ch, tmp.Name, q)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDelete(tmp.Name, false, true, false)
+	if err != nil {
+		return err
+	}
+	logging.Info("Queue migrated", logging.Fields{"queue": q.Name, "moved": moved})
+	return nil
+}
+
+func move(ch *amqp.Channel, from string, to Queue) (int, error) {
+	count := 0
+	for {
+		d, ok, err := ch.Get(from, false)
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			return count, nil
+		}
+		msg := to.Publishing(d.ContentType, d.Body)
+		msg.Headers = d.Headers
+		err = ch.Publish("", to.Name, false, false, msg)
+		if err != nil {
+			return count, err
+		}
+		err = d.Ack(false)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -0,0 +1,65 @@
+package mq
+
+import (
+	"context"
+
+	"common/logging"
+	"common/tracing"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// tableCarrier passes the trace context in the message headers.
+type tableCarrier amqp.Table
+
+func (t tableCarrier) Get(key string) string {
+	value, _ := t[key].(string)
+	return value
+}
+
+func (t tableCarrier) Set(key string, value string) {
+	t[key] = value
+}
+
+func (d *Delivery) remoteContext() context.Context {
+	return tracing.Extract(context.Background(), tableCarrier(d.Headers))
+}
+
+func startPublish(ctx context.Context, q Queue, msg *amqp.Publishing) (context.Context, trace.Span) {
+	ctx, span := tracing.Start(ctx, q.Name+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(kv.String("messaging.system", "rabbitmq"),
+			kv.String("messaging.destination", q.Name)))
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	tracing.Inject(ctx, tableCarrier(msg.Headers))
+	logging.Inject(ctx, tableCarrier(msg.Headers))
+	return ctx, span
+}
+
+// startProcess continues the trace and the request of a single message. A
+// group of merged messages gets a new trace linked to the traces of all its
+// messages, and a new request id.
+func startProcess(q Queue, ds []Delivery) (context.Context, trace.Span) {
+	opts := []trace.StartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(kv.String("messaging.system", "rabbitmq"),
+			kv.String("messaging.destination", q.Name),
+			kv.Int("messaging.batch_size", len(ds))),
+	}
+	if len(ds) == 1 {
+		ctx := logging.Extract(ds[0].remoteContext(), tableCarrier(ds[0].Headers))
+		return tracing.Start(ctx, q.Name+" process", opts...)
+	}
+	for _, d := range ds {
+		sc := trace.RemoteSpanContextFromContext(d.remoteContext())
+		if sc.IsValid() {
+			opts = append(opts, trace.LinkedTo(sc))
+		}
+	}
+	ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+	return tracing.Start(ctx, q.Name+" process", opts...)
+}
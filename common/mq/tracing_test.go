@@ -0,0 +1,95 @@
+package mq
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"common/tracing"
+)
+
+func TestTraceFollowsMessages(t *testing.T) {
+	memory, err := tracing.SetupMemory("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := newFakeBroker()
+	client, err := CreateClient(Config{
+		Prefetch:    1,
+		Concurrency: 1,
+		Migration:   "fail",
+		Topology:    []Queue{SmsMessages},
+		Dial:        broker.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	publisher, err := client.NewSmsPublisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{}, 1)
+	consumer, err := client.ConsumeSms(client.Options(), func(ctx context.Context, m SmsMessage) error {
+		_, span := tracing.StartQuery(ctx, "insert_message")
+		span.End()
+		handled <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop(context.Background())
+
+	server := httptest.NewServer(tracing.Handler("/confirm/{token}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/confirm/secret-token" {
+			t.Errorf("Handler got path %q", r.URL.Path)
+		}
+		err := publisher.Send(r.Context(), SmsMessage{To: "1", Message: "confirmed"})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	httpClient := http.Client{Transport: tracing.Transport(http.DefaultTransport)}
+	resp, err := httpClient.Get(server.URL + "/confirm/secret-token?code=123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Got status %d", resp.StatusCode)
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message wasn't consumed")
+	}
+	// The consumer span ends after the handler returns.
+	time.Sleep(100 * time.Millisecond)
+
+	spans := memory.Spans()
+	names := map[string]bool{}
+	for _, span := range spans {
+		names[span.Name] = true
+		if span.SpanContext.TraceID != spans[0].SpanContext.TraceID {
+			t.Errorf("Span %q belongs to another trace", span.Name)
+		}
+		for _, attr := range span.Attributes {
+			value := attr.Value.Emit()
+			if strings.Contains(value, "secret-token") || strings.Contains(value, "123456") {
+				t.Errorf("Span %q keeps %s=%s", span.Name, attr.Key, value)
+			}
+		}
+	}
+	for _, name := range []string{"GET", "/confirm/{token}", "sms_messages send", "sms_messages process", "db insert_message"} {
+		if !names[name] {
+			t.Errorf("No span %q in %v", name, names)
+		}
+	}
+}
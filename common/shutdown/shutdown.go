@@ -0,0 +1,120 @@
+package shutdown
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"common/logging"
+)
+
+type step struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+type Config struct {
+	Timeout    time.Duration `env:"SHUTDOWN_TIMEOUT" default:"30s" min:"0s"`
+	DrainDelay time.Duration `env:"SHUTDOWN_DRAIN_DELAY" default:"5s" min:"0s"`
+}
+
+// Shutdown runs the registered steps in order once the process receives
+// SIGINT or SIGTERM. All steps share one deadline, conf.Timeout.
+type Shutdown struct {
+	timeout    time.Duration
+	drainDelay time.Duration
+	steps      []step
+	signals    chan os.Signal
+	fatal      chan error
+}
+
+func CreateShutdown(conf Config) *Shutdown {
+	s := &Shutdown{timeout: conf.Timeout, drainDelay: conf.DrainDelay}
+	s.fatal = make(chan error, 1)
+	s.signals = make(chan os.Signal, 1)
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM)
+	return s
+}
+
+func (s *Shutdown) Add(name string, f func(ctx context.Context) error) {
+	s.steps = append(s.steps, step{name, f})
+}
+
+// AddCloser registers a step that can't be interrupted, e.g. closing a
+// connection.
+func (s *Shutdown) AddCloser(name string, f func()) {
+	s.Add(name, func(ctx context.Context) error {
+		f()
+		return nil
+	})
+}
+
+// Drain registers a step that withdraws readiness, followed by a pause of
+// conf.DrainDelay, so that load balancers notice it and stop sending new
+// requests before the following steps close the listeners.
+func (s *Shutdown) Drain(name string, f func(ctx context.Context) error) {
+	s.Add(name, func(ctx context.Context) error {
+		err := f(ctx)
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(s.drainDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// Fail reports a failure of a component the service can't work without.
+// The first one starts the shutdown.
+func (s *Shutdown) Fail(err error) {
+	select {
+	case s.fatal <- err:
+	default:
+	}
+}
+
+// ServeHTTP runs the server in the background and registers its graceful
+// shutdown: the listener is closed and in-flight requests are completed.
+func (s *Shutdown) ServeHTTP(name string, server *http.Server) {
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			s.Fail(err)
+		}
+	}()
+	s.Add(name, server.Shutdown)
+}
+
+// Wait blocks until a termination signal arrives or a component fails, then
+// runs the steps. It returns the failure if that was the reason.
+func (s *Shutdown) Wait() error {
+	var reason error
+	select {
+	case sig := <-s.signals:
+		logging.Info("Shutting down", logging.Fields{"signal": sig})
+	case reason = <-s.fatal:
+		logging.Error("Shutting down after a failure", logging.Fields{"error": reason})
+	}
+	s.Run()
+	return reason
+}
+
+func (s *Shutdown) Run() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	for _, step := range s.steps {
+		err := step.f(ctx)
+		if err != nil {
+			logging.Error("Failed to stop "+step.name, logging.Fields{"error": err})
+		}
+	}
+	logging.Info("Shutdown completed")
+}
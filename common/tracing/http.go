@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel/plugin/grpctrace"
+	"go.opentelemetry.io/otel/plugin/othttp"
+	"google.golang.org/grpc"
+)
+
+type urlKey struct{}
+
+type savedURL struct {
+	url        *url.URL
+	requestURI string
+}
+
+// othttp records the full URL of every request. Paths carry tokens and
+// queries of the provider calls carry phone numbers and codes, so othttp
+// gets the request with the URL reduced to the route or the host, and the
+// original URL is restored behind it.
+func hideURL(r *http.Request, short *url.URL) *http.Request {
+	ctx := context.WithValue(r.Context(), urlKey{}, savedURL{r.URL, r.RequestURI})
+	hidden := r.Clone(ctx)
+	hidden.URL = short
+	if r.RequestURI != "" {
+		hidden.RequestURI = short.RequestURI()
+	}
+	return hidden
+}
+
+func restoreURL(r *http.Request) *http.Request {
+	saved, ok := r.Context().Value(urlKey{}).(savedURL)
+	if !ok {
+		return r
+	}
+	restored := r.WithContext(r.Context())
+	restored.URL = saved.url
+	restored.RequestURI = saved.requestURI
+	return restored
+}
+
+// Handler starts a server span for every request of the route, continuing
+// the trace from the request headers. The span keeps the route instead of
+// the request path.
+func Handler(route string, h http.HandlerFunc) http.HandlerFunc {
+	traced := othttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h(w, restoreURL(r))
+	}), route, othttp.WithTracer(Tracer()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		traced.ServeHTTP(w, hideURL(r, &url.URL{Path: route}))
+	}
+}
+
+type transport struct {
+	traced http.RoundTripper
+}
+
+func (t transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.traced.RoundTrip(hideURL(r, &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}))
+}
+
+type restoringTransport struct {
+	base http.RoundTripper
+}
+
+func (t restoringTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(restoreURL(r))
+}
+
+// Transport injects the trace context into the outgoing requests. The span
+// keeps only the host of the request URL.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return transport{othttp.NewTransport(restoringTransport{base}, othttp.WithTracer(Tracer()))}
+}
+
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return grpctrace.UnaryServerInterceptor(Tracer())
+}
+
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return grpctrace.UnaryClientInterceptor(Tracer())
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Memory collects the spans in memory instead of exporting them. It is
+// meant for tests that check the produced traces.
+type Memory struct {
+	mutex sync.Mutex
+	spans []*export.SpanData
+}
+
+// SetupMemory installs a tracer provider that records every span into the
+// returned Memory.
+func SetupMemory(service string) (*Memory, error) {
+	m := &Memory{}
+	_, err := install(service, sdktrace.NewSimpleSpanProcessor(m))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Memory) ExportSpan(ctx context.Context, span *export.SpanData) {
+	m.mutex.Lock()
+	m.spans = append(m.spans, span)
+	m.mutex.Unlock()
+}
+
+// Spans returns the finished spans in the order they ended.
+func (m *Memory) Spans() []*export.SpanData {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*export.SpanData(nil), m.spans...)
+}
+
+func (m *Memory) Reset() {
+	m.mutex.Lock()
+	m.spans = nil
+	m.mutex.Unlock()
+}
@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const tracerName = "dist-sys"
+
+// Tracing owns the global tracer provider of the service.
+type Tracing struct {
+	provider  *sdktrace.Provider
+	processor sdktrace.SpanProcessor
+	exporter  *otlp.Exporter
+}
+
+func install(service string, processor sdktrace.SpanProcessor) (*sdktrace.Provider, error) {
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(kv.String("service.name", service))))
+	if err != nil {
+		return nil, err
+	}
+	if processor != nil {
+		provider.RegisterSpanProcessor(processor)
+	}
+	global.SetTraceProvider(provider)
+	return provider, nil
+}
+
+type Config struct {
+	Endpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+}
+
+// Setup exports the spans of the service to the OTLP collector at
+// conf.Endpoint. Without the endpoint spans are created but not exported, so
+// the trace context is still passed on to the next services.
+func Setup(service string, conf Config) (*Tracing, error) {
+	if len(conf.Endpoint) == 0 {
+		provider, err := install(service, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &Tracing{provider: provider}, nil
+	}
+	exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(conf.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	processor, err := sdktrace.NewBatchSpanProcessor(exporter)
+	if err != nil {
+		exporter.Stop()
+		return nil, err
+	}
+	provider, err := install(service, processor)
+	if err != nil {
+		processor.Shutdown()
+		exporter.Stop()
+		return nil, err
+	}
+	return &Tracing{provider, processor, exporter}, nil
+}
+
+// Close flushes the pending spans.
+func (t *Tracing) Close() {
+	if t.processor == nil {
+		return
+	}
+	t.provider.UnregisterSpanProcessor(t.processor)
+	if t.exporter != nil {
+		t.exporter.Stop()
+	}
+}
+
+func Tracer() trace.Tracer {
+	return global.Tracer(tracerName)
+}
+
+func Start(ctx context.Context, name string, opts ...trace.StartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// StartQuery starts a client span of a database query.
+func StartQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	return Start(ctx, "db "+query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(kv.String("db.system", "postgresql")))
+}
+
+// Detach returns a context that carries the span of ctx but is never
+// cancelled. It is used for the work that outlives the request.
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// Inject writes the trace context of ctx into the carrier.
+func Inject(ctx context.Context, carrier propagation.HTTPSupplier) {
+	propagation.InjectHTTP(ctx, global.Propagators(), carrier)
+}
+
+// Extract returns ctx with the remote trace context read from the carrier.
+func Extract(ctx context.Context, carrier propagation.HTTPSupplier) context.Context {
+	return propagation.ExtractHTTP(ctx, global.Propagators(), carrier)
+}
+
+// MapCarrier keeps the trace context in a map, e.g. to store it with a
+// message that is sent later.
+type MapCarrier map[string]string
+
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c MapCarrier) Set(key string, value string) {
+	c[key] = value
+}
@@ -0,0 +1,27 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	tracing, err := Setup("test", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracing.Close()
+	ctx, span := Start(context.Background(), "request")
+	defer span.End()
+	carrier := MapCarrier{}
+	Inject(ctx, carrier)
+	if len(carrier["traceparent"]) == 0 {
+		t.Errorf("Got no traceparent in %v", carrier)
+	}
+	remote := Extract(context.Background(), carrier)
+	_, child := Start(remote, "next")
+	defer child.End()
+	if child.SpanContext().TraceID != span.SpanContext().TraceID {
+		t.Error("Trace context was not passed on")
+	}
+}
@@ -4,7 +4,4 @@ go 1.13
 
 replace common => ../common
 
-require (
-	common v0.0.0-00010101000000-000000000000
-	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
-)
+require common v0.0.0-00010101000000-000000000000
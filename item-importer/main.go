@@ -1,36 +1,124 @@
 package main
 
 import (
+	"common/auth"
+	"common/config"
 	"common/dbclient"
-	"encoding/json"
-	"item-importer/mqclient"
+	"common/health"
+	"common/logging"
+	"common/metrics"
+	"common/mq"
+	"common/shutdown"
+	"common/tracing"
+	"context"
 	"log"
+	"net/http"
+	"time"
 )
 
+type Config struct {
+	HTTPAddress  string `env:"HTTP_ADDRESS" default:":8080"`
+	AdminAddress string `env:"ADMIN_ADDRESS"`
+	// The number of workers and the prefetch are MQ_CONCURRENCY and
+	// MQ_PREFETCH of the MQ config.
+	MergeBatches int           `env:"IMPORT_MERGE_BATCHES" default:"1" min:"1"`
+	MergeWait    time.Duration `env:"IMPORT_MERGE_WAIT" default:"100ms" min:"0s"`
+	// Ids of processed batches are kept for BatchIDRetention to skip
+	// redelivered batches, see docs/import.md for the window it must cover.
+	BatchIDRetention time.Duration `env:"PROCESSED_BATCHES_RETENTION" default:"168h" min:"1h"`
+	CleanupInterval  time.Duration `env:"PROCESSED_BATCHES_CLEANUP_INTERVAL" default:"1h" min:"1m"`
+
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+	Database dbclient.Config
+	MQ       mq.Config
+	// Auth checks the permission of the admin requests, it is needed only
+	// with the admin server.
+	Auth *auth.Config `when:"ADMIN_ADDRESS"`
+}
+
+var conf Config
+
+func runJanitor(db dbclient.Client, period time.Duration) {
+	for range time.Tick(period) {
+		deleted, err := db.DeleteProcessedBatches(context.Background(), conf.BatchIDRetention)
+		if err != nil {
+			logging.Error("Failed to delete processed batch ids", logging.Fields{"error": err})
+			continue
+		}
+		if deleted != 0 {
+			logging.Info("Deleted processed batch ids", logging.Fields{"count": deleted})
+		}
+	}
+}
+
 func main() {
-	db, err := dbclient.CreateDbClient()
+	config.MustLoad(&conf)
+	err := logging.Setup("item-importer", conf.Log)
 	if err != nil {
 		log.Panic(err)
 	}
-	cl, err := mqclient.CreateMqClient()
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("item-importer", conf.Tracing)
 	if err != nil {
 		log.Panic(err)
 	}
-	msgs, err := cl.GetMessages()
+	db, err := dbclient.CreateDbClient(conf.Database)
 	if err != nil {
 		log.Panic(err)
 	}
-	log.Println("Item-importer service started")
-	for m := range msgs {
-		var batch []dbclient.Item
-		json.Unmarshal(m.Body, &batch)
-		err := db.ImportItemBatch(batch)
+	go runJanitor(db, conf.CleanupInterval)
+	conf.MQ.Topology = []mq.Queue{mq.BatchImport}
+	cl, err := mq.CreateClient(conf.MQ)
+	if err != nil {
+		log.Panic(err)
+	}
+	opts := cl.Options()
+	opts.MergeMessages = conf.MergeBatches
+	opts.MergeWait = conf.MergeWait
+	// Workers wait for MergeWait without enough unacked messages.
+	if opts.Prefetch != 0 && opts.Prefetch < opts.Concurrency*opts.MergeMessages {
+		logging.Warn("MQ_PREFETCH is raised to MQ_CONCURRENCY * IMPORT_MERGE_BATCHES", logging.Fields{
+			"prefetch": opts.Concurrency * opts.MergeMessages,
+		})
+		opts.Prefetch = opts.Concurrency * opts.MergeMessages
+	}
+	consumer, err := cl.ConsumeImportBatches(opts, db.ImportItemBatches)
+	if err != nil {
+		log.Panic(err)
+	}
+	go func() {
+		err := consumer.Wait()
 		if err != nil {
-			log.Panic(err)
+			sd.Fail(err)
 		}
-		err = m.Ack(false)
+	}()
+	hc := health.CreateHealth()
+	hc.Add("database", db.Ping)
+	hc.AddPing("message queue", cl.Ping)
+	mux := http.NewServeMux()
+	hc.Register(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress, Handler: mux})
+	sd.Add("consumer", consumer.Stop)
+	if len(conf.AdminAddress) != 0 {
+		ac, err := auth.CreateAuthClient(*conf.Auth)
 		if err != nil {
 			log.Panic(err)
 		}
+		admin := http.NewServeMux()
+		admin.Handle("/admin/dlq/", cl.AdminHandler("/admin/dlq/", ac.Require("manage")))
+		sd.ServeHTTP("admin server", &http.Server{Addr: conf.AdminAddress, Handler: admin})
+		sd.AddCloser("auth client", func() { ac.Close() })
+	}
+	sd.AddCloser("message queue", func() { cl.Close() })
+	sd.AddCloser("database", db.Close)
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Item-importer service started")
+	err = sd.Wait()
+	if err != nil {
+		log.Panic(err)
 	}
 }
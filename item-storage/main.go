@@ -1,82 +1,60 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 
 	"common/auth"
+	"common/config"
 	"common/dbclient"
+	"common/health"
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
+	"common/shutdown"
+	"common/tracing"
 )
 
 type Item = dbclient.Item
 
-var db dbclient.Client
-var ac auth.AuthClient
-
-func respondOK(w http.ResponseWriter, result interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
-}
-
-type errorResponse struct {
-	Error string `json:"error"`
-}
+type Config struct {
+	HTTPAddress string `env:"HTTP_ADDRESS" default:":8080"`
 
-func respondWithError(w http.ResponseWriter, err error, statusCode int) {
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(errorResponse{err.Error()})
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+	Auth     auth.Config
+	Database dbclient.Config
+	CORS     httpx.CORSConfig
 }
 
-func parseUint(s string) (uint64, error) {
-	return strconv.ParseUint(s, 10, 64)
-}
-
-func parseInt(s string) (int64, error) {
-	return strconv.ParseInt(s, 10, 64)
-}
-
-func extractIndexFromUrl(url string, pref string) (uint64, error) {
-	return parseUint(strings.TrimPrefix(url, pref))
-}
+var db dbclient.Client
+var ac auth.AuthClient
 
-func checkPermission(w http.ResponseWriter, r *http.Request, perm string) bool {
-	token := r.Header.Get("auth")
-	err := ac.CheckPermission(token, perm)
-	if err != nil {
-		respondWithError(w, err, http.StatusForbidden)
-		return false
+func notFoundOr(err error) error {
+	if err == dbclient.ErrNotFound {
+		return httpx.NotFound(err)
 	}
-	return true
+	return err
 }
 
 type getItemResponse = Item
 
 func getItemHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "read") {
-		return
-	}
-	id, err := extractIndexFromUrl(r.URL.Path, "/item/")
+	id, err := httpx.ParamUint(r, "id")
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	item, err := db.GetItem(id)
+	item, err := db.GetItem(r.Context(), id)
 	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, err, http.StatusNotFound)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
-		}
+		httpx.RespondError(w, r, notFoundOr(err))
 		return
 	}
-	respondOK(w, item)
+	httpx.RespondOK(w, item)
 }
 
 type postItemResponse struct {
@@ -84,99 +62,68 @@ type postItemResponse struct {
 }
 
 func postItemHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "write") {
-		return
-	}
 	var item Item
-	err := json.NewDecoder(r.Body).Decode(&item)
+	err := httpx.DecodeJSON(r, &item)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	id, err := db.NewItem(item)
+	id, err := db.NewItem(r.Context(), item)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, postItemResponse{id})
+	httpx.RespondOK(w, postItemResponse{id})
 }
 
 type putItemResponse struct{}
 
 func putItemHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "write") {
-		return
-	}
-	id, err := extractIndexFromUrl(r.URL.Path, "/item/")
+	id, err := httpx.ParamUint(r, "id")
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
 	var item Item
-	err = json.NewDecoder(r.Body).Decode(&item)
+	err = httpx.DecodeJSON(r, &item)
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
 	item.ID = id
-	err = db.UpdateItem(item)
+	err = db.UpdateItem(r.Context(), item)
 	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, err, http.StatusNotFound)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
-		}
+		httpx.RespondError(w, r, notFoundOr(err))
 		return
 	}
-	respondOK(w, putItemResponse{})
+	httpx.RespondOK(w, putItemResponse{})
 }
 
 type deleteItemResponse struct{}
 
 func deleteItemHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "write") {
-		return
-	}
-	id, err := extractIndexFromUrl(r.URL.Path, "/item/")
+	id, err := httpx.ParamUint(r, "id")
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	err = db.DeleteItem(id)
+	err = db.DeleteItem(r.Context(), id)
 	if err != nil {
-		switch err {
-		case dbclient.ErrNotFound:
-			respondWithError(w, err, http.StatusNotFound)
-		default:
-			respondWithError(w, err, http.StatusInternalServerError)
-		}
+		httpx.RespondError(w, r, notFoundOr(err))
 		return
 	}
-	respondOK(w, deleteItemResponse{})
-}
-
-func generalItemHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		getItemHandler(w, r)
-	case "POST":
-		postItemHandler(w, r)
-	case "PUT":
-		putItemHandler(w, r)
-	case "DELETE":
-		deleteItemHandler(w, r)
-	default:
-		w.Header().Add("Allow", "GET, POST, PUT, DELETE")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+	httpx.RespondOK(w, deleteItemResponse{})
 }
 
 func extractUintFromParams(params url.Values, name string) (uint64, error) {
 	if len(params[name]) != 1 {
-		return 0, fmt.Errorf("Only one parameter '%v' can be specified", name)
+		return 0, httpx.BadRequest(fmt.Errorf("Only one parameter '%v' can be specified", name))
 	}
-	return parseUint(params[name][0])
+	value, err := strconv.ParseUint(params[name][0], 10, 64)
+	if err != nil {
+		return 0, httpx.BadRequest(fmt.Errorf("Parameter '%v' should be a non-negative integer", name))
+	}
+	return value, nil
 }
 
 type getItemsResponse struct {
@@ -185,15 +132,12 @@ type getItemsResponse struct {
 }
 
 func getItemsHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "read") {
-		return
-	}
 	var options dbclient.GetItemListOptions
 	params := r.URL.Query()
 	if params["offset"] != nil {
 		offset, err := extractUintFromParams(params, "offset")
 		if err != nil {
-			respondWithError(w, err, http.StatusBadRequest)
+			httpx.RespondError(w, r, err)
 			return
 		}
 		options.Offset = offset
@@ -202,7 +146,7 @@ func getItemsHandler(w http.ResponseWriter, r *http.Request) {
 	if params["limit"] != nil {
 		sLimit, err := extractUintFromParams(params, "limit")
 		if err != nil {
-			respondWithError(w, err, http.StatusBadRequest)
+			httpx.RespondError(w, r, err)
 			return
 		}
 		if sLimit < limit {
@@ -213,42 +157,60 @@ func getItemsHandler(w http.ResponseWriter, r *http.Request) {
 	if params["category"] != nil {
 		options.Categories = params["category"]
 	}
-	items, err := db.GetItemList(options)
+	items, err := db.GetItemList(r.Context(), options)
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	size, err := db.GetItemListSize()
+	size, err := db.GetItemListSize(r.Context())
 	if err != nil {
-		respondWithError(w, err, http.StatusInternalServerError)
+		httpx.RespondError(w, r, err)
 		return
 	}
-	respondOK(w, getItemsResponse{size, items})
-}
-
-func generalItemsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		getItemsHandler(w, r)
-	default:
-		w.Header().Add("Allow", "GET")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+	httpx.RespondOK(w, getItemsResponse{size, items})
 }
 
 func main() {
-	var err error
-	ac, err = auth.CreateAuthClient()
+	var conf Config
+	config.MustLoad(&conf)
+	err := logging.Setup("item-storage", conf.Log)
+	if err != nil {
+		log.Panic(err)
+	}
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("item-storage", conf.Tracing)
+	if err != nil {
+		log.Panic(err)
+	}
+	ac, err = auth.CreateAuthClient(conf.Auth)
+	if err != nil {
+		log.Panic(err)
+	}
+	db, err = dbclient.CreateDbClient(conf.Database)
 	if err != nil {
 		log.Panic(err)
 	}
-	db, err = dbclient.CreateDbClient()
+	router := httpx.CreateRouter()
+	router.Use(httpx.CORS(conf.CORS))
+	router.Get("/items", getItemsHandler, ac.Require("read"))
+	router.Post("/item", postItemHandler, ac.Require("write"))
+	router.Get("/item/{id}", getItemHandler, ac.Require("read"))
+	router.Put("/item/{id}", putItemHandler, ac.Require("write"))
+	router.Delete("/item/{id}", deleteItemHandler, ac.Require("write"))
+	http.Handle("/", router)
+	hc := health.CreateHealth()
+	hc.Add("database", db.Ping)
+	hc.Add("auth", ac.Ping)
+	hc.Register(http.DefaultServeMux)
+	http.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress})
+	sd.AddCloser("auth client", func() { ac.Close() })
+	sd.AddCloser("database", db.Close)
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Item-storage started")
+	err = sd.Wait()
 	if err != nil {
 		log.Panic(err)
 	}
-	http.HandleFunc("/items", generalItemsHandler)
-	http.HandleFunc("/item", generalItemHandler)
-	http.HandleFunc("/item/", generalItemHandler)
-	log.Println("Item-storage started")
-	log.Panic(http.ListenAndServe(":8080", nil))
 }
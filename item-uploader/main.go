@@ -2,86 +2,79 @@ package main
 
 import (
 	"common/auth"
+	"common/config"
 	"common/dbclient"
+	"common/health"
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
+	"common/mq"
+	"common/shutdown"
+	"common/tracing"
+	"context"
 	"encoding/csv"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"item-uploader/mqclient"
+	"item-uploader/outbox"
+	"item-uploader/upstore"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"time"
 )
 
 type Config struct {
-	BatchSize int
-}
+	HTTPAddress        string        `env:"HTTP_ADDRESS" default:":8080"`
+	BatchSize          int           `env:"BATCH_SIZE" default:"100" min:"1" max:"10000"`
+	ChunkBatches       int           `env:"IMPORT_CHUNK_BATCHES" default:"10" min:"1" max:"1000"`
+	UploadDir          string        `env:"UPLOAD_DIR" required:"true"`
+	UploadLifeTime     time.Duration `env:"UPLOAD_LIFE_TIME" default:"24h" min:"1m"`
+	MaxUploadSize      int64         `env:"MAX_UPLOAD_SIZE" default:"1073741824" min:"1"`
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" default:"5s" min:"10ms"`
 
-func (c *Config) Load() error {
-	batch_size, err := strconv.ParseInt(os.Getenv("BATCH_SIZE"), 10, 32)
-	if err != nil {
-		return err
-	}
-	c.BatchSize = int(batch_size)
-	return nil
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+	Auth     auth.Config
+	Database dbclient.Config
+	MQ       mq.Config
+	CORS     httpx.CORSConfig
 }
 
 var conf Config
-var mq mqclient.Client
+var batches mq.ImportBatchPublisher
+var ob outbox.Client
 var ac auth.AuthClient
 
-func respondOK(w http.ResponseWriter, result interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+// csvError is a malformed file, importing it again fails the same way.
+type csvError struct {
+	err error
 }
 
-type errorResponse struct {
-	Error string `json:"error"`
+func (e csvError) Error() string {
+	return e.err.Error()
 }
 
-func respondWithError(w http.ResponseWriter, err error, statusCode int) {
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(errorResponse{err.Error()})
-}
-
-func checkPermission(w http.ResponseWriter, r *http.Request, perm string) bool {
-	token := r.Header.Get("auth")
-	err := ac.CheckPermission(token, perm)
-	if err != nil {
-		respondWithError(w, err, http.StatusForbidden)
-		return false
+func readCsv(r *csv.Reader) ([]string, error) {
+	values, err := r.Read()
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, csvError{err}
 	}
-	return true
+	return values, err
 }
 
-type postImportResponse struct{}
-
-func postImportHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkPermission(w, r, "write") {
-		return
-	}
-	reader, err := r.MultipartReader()
-	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
-		return
-	}
-	part, err := reader.NextPart()
-	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
-		return
+// importCsv saves the items into the outbox in chunks of conf.ChunkBatches
+// batches, each chunk in its own transaction. Batch ids are derived from
+// importID, so when a failed import is repeated, item-importer skips the
+// batches of the chunks that were saved before.
+func importCsv(ctx context.Context, importID string, r io.Reader) error {
+	csvreader := csv.NewReader(r)
+	names, err := readCsv(csvreader)
+	if err == io.EOF {
+		return csvError{errors.New("File should start with the column names")}
 	}
-	if part.FormName() != "file" {
-		log.Println("Expected file, got " + part.FormName())
-		respondWithError(w, errors.New("File is expected"), http.StatusBadRequest)
-		return
-	}
-	csvreader := csv.NewReader(part)
-	names, err := csvreader.Read()
 	if err != nil {
-		respondWithError(w, err, http.StatusBadRequest)
-		return
+		return err
 	}
 	name_to_index := make(map[string]int)
 	for i, name := range names {
@@ -90,21 +83,34 @@ func postImportHandler(w http.ResponseWriter, r *http.Request) {
 	item_fields := [2]string{"title", "category"}
 	for _, field := range item_fields {
 		if _, ok := name_to_index[field]; !ok {
-			respondWithError(w, errors.New("Item should contain '"+field+"' field"), http.StatusBadRequest)
-			return
+			return csvError{errors.New("Item should contain '" + field + "' field")}
 		}
 	}
+	var writer *outbox.Writer
+	defer func() {
+		if writer != nil {
+			writer.Rollback()
+		}
+	}()
+	commit := func() error {
+		err := writer.Commit(ctx)
+		writer = nil
+		if err == nil {
+			wakeRelay()
+		}
+		return err
+	}
 	closed := false
 
 	var batch []dbclient.Item
+	batches := 0
 
 	for !closed {
-		values, err := csvreader.Read()
+		values, err := readCsv(csvreader)
 		if err == io.EOF {
 			closed = true
 		} else if err != nil {
-			respondWithError(w, err, http.StatusBadRequest)
-			return
+			return err
 		} else {
 			var item dbclient.Item
 			item.Title = values[name_to_index["title"]]
@@ -115,37 +121,134 @@ func postImportHandler(w http.ResponseWriter, r *http.Request) {
 			batch = append(batch, item)
 		}
 		if len(batch) == conf.BatchSize || (closed && len(batch) != 0) {
-			mq.SendImportBatch(batch)
+			if writer == nil {
+				w, err := ob.Begin(ctx)
+				if err != nil {
+					return err
+				}
+				writer = &w
+			}
+			err = writer.Add(ctx, fmt.Sprintf("%s-%d", importID, batches), batch)
+			if err != nil {
+				return err
+			}
+			batch = nil
+			batches++
+			if batches%conf.ChunkBatches == 0 {
+				err = commit()
+				if err != nil {
+					return err
+				}
+			}
 		}
 	}
-	respondOK(w, postImportResponse{})
+	if writer != nil {
+		return commit()
+	}
+	return nil
 }
 
-func generalImportHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "POST":
-		postImportHandler(w, r)
-	default:
-		w.Header().Add("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+type postImportResponse struct{}
+
+func postImportHandler(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		httpx.RespondError(w, r, httpx.BadRequest(err))
+		return
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		httpx.RespondError(w, r, httpx.BadRequest(err))
+		return
+	}
+	if part.FormName() != "file" {
+		logging.FromContext(r.Context()).Warn("Unexpected form part", logging.Fields{"part": part.FormName()})
+		httpx.RespondError(w, r, httpx.BadRequest(errors.New("File is expected")))
+		return
+	}
+	err = importCsv(r.Context(), outbox.GenerateID(), part)
+	if err != nil {
+		// Other errors come from the database and are not shown to the
+		// client.
+		if _, malformed := err.(csvError); malformed {
+			err = httpx.BadRequest(err)
+		}
+		httpx.RespondError(w, r, err)
+		return
 	}
+	httpx.RespondOK(w, postImportResponse{})
 }
 
 func main() {
-	var err error
-	err = conf.Load()
+	config.MustLoad(&conf)
+	err := logging.Setup("item-uploader", conf.Log)
 	if err != nil {
 		log.Panic(err)
 	}
-	ac, err = auth.CreateAuthClient()
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("item-uploader", conf.Tracing)
 	if err != nil {
 		log.Panic(err)
 	}
-	mq, err = mqclient.CreateMqClient()
+	ac, err = auth.CreateAuthClient(conf.Auth)
+	if err != nil {
+		log.Panic(err)
+	}
+	conf.MQ.Topology = []mq.Queue{mq.BatchImport}
+	mqc, err := mq.CreateClient(conf.MQ)
+	if err != nil {
+		log.Panic(err)
+	}
+	batches, err = mqc.NewImportBatchPublisher()
+	if err != nil {
+		log.Panic(err)
+	}
+	ob, err = outbox.CreateOutboxClient(conf.Database)
+	if err != nil {
+		log.Panic(err)
+	}
+	stopRelay := make(chan struct{})
+	relayDone := make(chan struct{})
+	go func() {
+		runOutboxRelay(conf.OutboxPollInterval, stopRelay)
+		close(relayDone)
+	}()
+	store, err = upstore.CreateStore(conf.UploadDir, conf.UploadLifeTime)
+	if err != nil {
+		log.Panic(err)
+	}
+	resumeCompletedUploads()
+	go runUploadJanitor(time.Minute)
+	router := httpx.CreateRouter()
+	router.Use(httpx.CORS(conf.CORS, tusHeaders...))
+	router.Post("/import", postImportHandler, ac.Require("write"))
+	registerUploadRoutes(router)
+	http.Handle("/", router)
+	hc := health.CreateHealth()
+	hc.Add("database", ob.Ping)
+	hc.AddPing("message queue", mqc.Ping)
+	hc.Add("auth", ac.Ping)
+	hc.Register(http.DefaultServeMux)
+	http.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress})
+	sd.Add("upload processing", waitProcessing)
+	sd.Add("outbox relay", func(ctx context.Context) error {
+		close(stopRelay)
+		select {
+		case <-relayDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	sd.AddCloser("outbox", ob.Destroy)
+	sd.AddCloser("message queue", func() { mqc.Close() })
+	sd.AddCloser("auth client", func() { ac.Close() })
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Item-uploader started")
+	err = sd.Wait()
 	if err != nil {
 		log.Panic(err)
 	}
-	http.HandleFunc("/import", generalImportHandler)
-	log.Println("Item-uploader started")
-	log.Panic(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,180 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"common/dbclient"
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type Client struct {
+	pool *pgxpool.Pool
+}
+
+func CreateOutboxClient(conf dbclient.Config) (Client, error) {
+	pool, err := pgxpool.Connect(context.Background(), conf.URL)
+	if err != nil {
+		return Client{}, err
+	}
+	_, err = pool.Exec(context.Background(),
+		`create table if not exists import_outbox (
+			id bigserial primary key,
+			batch jsonb not null,
+			created_at timestamp not null default now(),
+			attempts integer not null default 0
+		);`)
+	if err == nil {
+		_, err = pool.Exec(context.Background(),
+			`alter table import_outbox add column if not exists batch_id text`)
+	}
+	if err == nil {
+		_, err = pool.Exec(context.Background(),
+			`alter table import_outbox add column if not exists trace jsonb`)
+	}
+	if err != nil {
+		pool.Close()
+		return Client{}, err
+	}
+	return Client{pool}, nil
+}
+
+func (c *Client) Destroy() {
+	c.pool.Close()
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.pool.Exec(ctx, "select 1")
+	return err
+}
+
+type Writer struct {
+	tx pgx.Tx
+}
+
+// Begin starts a transaction that collects a chunk of batches of an upload.
+func (c *Client) Begin(ctx context.Context) (Writer, error) {
+	tx, err := c.pool.Begin(ctx)
+	return Writer{tx}, err
+}
+
+// GenerateID returns a random id of an import, its batches are numbered
+// within it.
+func GenerateID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// Add stores the items under the batch id. The id stays with the batch until
+// it is imported, so redeliveries can be detected by the consumer.
+// The trace context and the request id of ctx are stored too, so that the
+// batch is published within the trace of the upload.
+func (w *Writer) Add(ctx context.Context, batchID string, items []dbclient.Item) error {
+	defer metrics.ObserveQuery("outbox_add", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "outbox_add")
+	defer span.End()
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	trace := tracing.MapCarrier{}
+	tracing.Inject(ctx, trace)
+	logging.Inject(ctx, trace)
+	tbytes, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+	_, err = w.tx.Exec(ctx,
+		`insert into import_outbox (batch_id, batch, trace) values ($1, $2, $3)`,
+		batchID, bytes, tbytes)
+	return err
+}
+
+func (w *Writer) Commit(ctx context.Context) error {
+	return w.tx.Commit(ctx)
+}
+
+func (w *Writer) Rollback() error {
+	return w.tx.Rollback(context.Background())
+}
+
+type Entry struct {
+	ID    int64
+	Batch dbclient.ItemBatch
+	Trace tracing.MapCarrier
+}
+
+// Relay locks up to limit oldest entries and passes them to publish one by
+// one. Entries are deleted only after publish returns nil; the first failure
+// stops the round and its entry stays in the outbox for the next attempt.
+// Rows locked by other replicas are skipped.
+func (c *Client) Relay(limit int, publish func(Entry) error) (int, error) {
+	defer metrics.ObserveQuery("outbox_relay", time.Now())
+	tx, err := c.pool.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(),
+		`select id, coalesce(batch_id, 'outbox-' || id::text), batch, coalesce(trace, '{}') from import_outbox
+		order by id
+		limit $1
+		for update skip locked`, limit)
+	if err != nil {
+		return 0, err
+	}
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var bytes, tbytes []byte
+		err = rows.Scan(&entry.ID, &entry.Batch.ID, &bytes, &tbytes)
+		if err == nil {
+			err = json.Unmarshal(bytes, &entry.Batch.Items)
+		}
+		if err == nil {
+			err = json.Unmarshal(tbytes, &entry.Trace)
+		}
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+	sent := 0
+	var perr error
+	for _, entry := range entries {
+		perr = publish(entry)
+		if perr != nil {
+			_, err = tx.Exec(context.Background(),
+				`update import_outbox set attempts = attempts + 1 where id = $1`, entry.ID)
+			break
+		}
+		_, err = tx.Exec(context.Background(),
+			`delete from import_outbox where id = $1`, entry.ID)
+		if err != nil {
+			break
+		}
+		sent++
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return sent, perr
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"common/logging"
+	"common/tracing"
+	"item-uploader/outbox"
+)
+
+const relayBatchLimit = 100
+
+var relayWakeup = make(chan struct{}, 1)
+
+func wakeRelay() {
+	select {
+	case relayWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func publishEntry(entry outbox.Entry) error {
+	ctx := tracing.Extract(context.Background(), entry.Trace)
+	ctx = logging.Extract(ctx, entry.Trace)
+	return batches.Send(ctx, entry.Batch)
+}
+
+// runOutboxRelay moves batches from the outbox to the broker. It runs on
+// every poll tick and right after an upload is committed, and keeps going
+// while there is a backlog. Failed rounds are retried with a growing delay.
+// It returns once stop is closed and the current round is finished.
+func runOutboxRelay(pollInterval time.Duration, stop <-chan struct{}) {
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		sent, err := ob.Relay(relayBatchLimit, publishEntry)
+		if err != nil {
+			logging.Error("Outbox relay failed", logging.Fields{"error": err})
+			if backoff == 0 {
+				backoff = time.Second
+			} else if backoff < time.Minute {
+				backoff *= 2
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		if sent == relayBatchLimit {
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		case <-relayWakeup:
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"common/auth"
+	"common/httpx"
+	"common/logging"
+	"common/tracing"
+	"item-uploader/upstore"
+)
+
+const tusVersion = "1.0.0"
+
+const minImportRetryDelay = 10 * time.Second
+const maxImportRetryDelay = 10 * time.Minute
+
+var store *upstore.Store
+var processing sync.WaitGroup
+var stopProcessing = make(chan struct{})
+
+// tusHeaders are read by browser clients of the upload protocol.
+var tusHeaders = []string{"Location", "Upload-Offset", "Upload-Length", "Upload-Expires",
+	"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size"}
+
+// tusResumable rejects requests of other protocol versions.
+func tusResumable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != "OPTIONS" && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			httpx.RespondError(w, r, httpx.NewError(http.StatusPreconditionFailed, "unsupported_version",
+				"Tus-Resumable "+tusVersion+" is expected"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func getOwnUpload(w http.ResponseWriter, r *http.Request) (upstore.Upload, bool) {
+	u, err := store.Get(httpx.Param(r, "id"))
+	if err == nil && u.Owner != auth.User(r.Context()).Username {
+		err = upstore.ErrNotFound
+	}
+	if err != nil {
+		if err == upstore.ErrNotFound {
+			err = httpx.NotFound(err)
+		}
+		httpx.RespondError(w, r, err)
+		return u, false
+	}
+	return u, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, u upstore.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if !u.Completed() {
+		w.Header().Set("Upload-Expires", u.ExpTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// processUpload imports the upload and deletes it unless the import should
+// be retried. A malformed file is deleted as well, as it can't be imported.
+func processUpload(ctx context.Context, u upstore.Upload) bool {
+	ctx, span := tracing.Start(ctx, "import upload")
+	defer span.End()
+	logger := logging.FromContext(ctx).With(logging.Fields{"upload_id": u.ID})
+	file, err := store.Open(u.ID)
+	if err != nil {
+		logger.Error("Failed to open upload", logging.Fields{"error": err})
+		return !os.IsNotExist(err)
+	}
+	err = importCsv(ctx, u.ID, file)
+	file.Close()
+	if _, malformed := err.(csvError); err != nil && !malformed {
+		span.RecordError(ctx, err)
+		logger.Error("Failed to import upload, will retry", logging.Fields{"error": err})
+		return true
+	}
+	if err != nil {
+		logger.Warn("Upload is not a valid CSV file", logging.Fields{"error": err})
+	} else {
+		logger.Info("Upload imported")
+	}
+	err = store.Delete(u.ID)
+	if err != nil {
+		logger.Error("Failed to delete upload", logging.Fields{"error": err})
+	}
+	return false
+}
+
+func startProcessing(ctx context.Context, u upstore.Upload) {
+	processing.Add(1)
+	go func() {
+		defer processing.Done()
+		delay := minImportRetryDelay
+		for processUpload(ctx, u) {
+			select {
+			case <-time.After(delay):
+			case <-stopProcessing:
+				return
+			}
+			delay *= 2
+			if delay > maxImportRetryDelay {
+				delay = maxImportRetryDelay
+			}
+		}
+	}()
+}
+
+// waitProcessing waits for the imports of completed uploads. Interrupted
+// imports and imports waiting for a retry are restarted with the next
+// launch.
+func waitProcessing(ctx context.Context) error {
+	close(stopProcessing)
+	done := make(chan struct{})
+	go func() {
+		processing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func postUploadHandler(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		httpx.RespondError(w, r, httpx.BadRequest(errors.New("Upload-Length should be a positive integer")))
+		return
+	}
+	if length > conf.MaxUploadSize {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(conf.MaxUploadSize, 10))
+		httpx.RespondError(w, r, httpx.NewError(http.StatusRequestEntityTooLarge, "too_large",
+			"Upload-Length exceeds "+strconv.FormatInt(conf.MaxUploadSize, 10)+" bytes"))
+		return
+	}
+	u, err := store.Create(auth.User(r.Context()).Username, length)
+	if err != nil {
+		httpx.RespondError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/uploads/"+u.ID)
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := getOwnUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+func patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		httpx.RespondError(w, r, httpx.NewError(http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Content-Type should be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		httpx.RespondError(w, r, httpx.BadRequest(errors.New("Upload-Offset should be an integer")))
+		return
+	}
+	u, ok := getOwnUpload(w, r)
+	if !ok {
+		return
+	}
+	if u.Completed() {
+		httpx.RespondError(w, r, httpx.Conflict(errors.New("Upload is already completed")))
+		return
+	}
+	u, err = store.WriteChunk(u.ID, offset, r.Body)
+	if err != nil {
+		switch err {
+		case upstore.ErrOffsetMismatch, upstore.ErrBusy:
+			setUploadHeaders(w, u)
+			err = httpx.Conflict(err)
+		case upstore.ErrTooLarge:
+			err = httpx.NewError(http.StatusRequestEntityTooLarge, "too_large", err.Error())
+		}
+		httpx.RespondError(w, r, err)
+		return
+	}
+	if u.Completed() {
+		startProcessing(tracing.Detach(r.Context()), u)
+	}
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func optionsUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(conf.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func registerUploadRoutes(router *httpx.Router) {
+	write := ac.Require("write")
+	router.Handle("OPTIONS", "/uploads", optionsUploadHandler, tusResumable)
+	router.Post("/uploads", postUploadHandler, tusResumable, write)
+	router.Handle("OPTIONS", "/uploads/{id}", optionsUploadHandler, tusResumable)
+	router.Handle("HEAD", "/uploads/{id}", headUploadHandler, tusResumable, write)
+	router.Patch("/uploads/{id}", patchUploadHandler, tusResumable, write)
+}
+
+func resumeCompletedUploads() {
+	uploads, err := store.ListCompleted()
+	if err != nil {
+		logging.Error("Failed to list completed uploads", logging.Fields{"error": err})
+		return
+	}
+	for _, u := range uploads {
+		startProcessing(context.Background(), u)
+	}
+}
+
+func runUploadJanitor(period time.Duration) {
+	for range time.Tick(period) {
+		count, err := store.DeleteExpired(time.Now())
+		if err != nil {
+			logging.Error("Failed to delete expired uploads", logging.Fields{"error": err})
+		}
+		if count != 0 {
+			logging.Info("Deleted expired uploads", logging.Fields{"count": count})
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package upstore
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("Upload not found")
+var ErrOffsetMismatch = errors.New("Upload offset doesn't match the current one")
+var ErrTooLarge = errors.New("Chunk exceeds the declared upload length")
+var ErrBusy = errors.New("Upload is being written by another request")
+
+type Upload struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"offset"`
+	ExpTime time.Time `json:"exp_time"`
+}
+
+func (u *Upload) Completed() bool {
+	return u.Offset == u.Length
+}
+
+type Store struct {
+	dir      string
+	lifeTime time.Duration
+	mutex    sync.Mutex
+	busy     map[string]bool
+}
+
+func CreateStore(dir string, lifeTime time.Duration) (*Store, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		dir:      dir,
+		lifeTime: lifeTime,
+		busy:     make(map[string]bool),
+	}
+	return store, nil
+}
+
+func generateID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *Store) saveInfo(u Upload) error {
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(u.ID) + ".tmp"
+	err = ioutil.WriteFile(tmp, bytes, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+func (s *Store) loadInfo(id string) (Upload, error) {
+	var u Upload
+	if len(id) == 0 || strings.ContainsAny(id, `/\.`) {
+		return u, ErrNotFound
+	}
+	bytes, err := ioutil.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, err
+	}
+	err = json.Unmarshal(bytes, &u)
+	return u, err
+}
+
+func (s *Store) Create(owner string, length int64) (Upload, error) {
+	u := Upload{
+		ID:      generateID(),
+		Owner:   owner,
+		Length:  length,
+		ExpTime: time.Now().Add(s.lifeTime),
+	}
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return u, err
+	}
+	f.Close()
+	err = s.saveInfo(u)
+	return u, err
+}
+
+func (s *Store) Get(id string) (Upload, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadInfo(id)
+}
+
+func (s *Store) acquire(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.busy[id] {
+		return ErrBusy
+	}
+	s.busy[id] = true
+	return nil
+}
+
+func (s *Store) release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.busy, id)
+}
+
+// WriteChunk appends data to the upload starting at offset. Whatever was
+// read before a broken connection is kept, so the client can resume from
+// the offset returned with the error.
+func (s *Store) WriteChunk(id string, offset int64, data io.Reader) (Upload, error) {
+	err := s.acquire(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer s.release(id)
+	u, err := s.Get(id)
+	if err != nil {
+		return u, err
+	}
+	if u.Offset != offset {
+		return u, ErrOffsetMismatch
+	}
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return u, err
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return u, err
+	}
+	written, err := io.Copy(f, io.LimitReader(data, u.Length-u.Offset+1))
+	if u.Offset+written > u.Length {
+		f.Truncate(u.Length)
+		return u, ErrTooLarge
+	}
+	u.Offset += written
+	u.ExpTime = time.Now().Add(s.lifeTime)
+	serr := s.saveInfo(u)
+	if err == nil {
+		err = serr
+	}
+	return u, err
+}
+
+func (s *Store) Open(id string) (io.ReadCloser, error) {
+	return os.Open(s.dataPath(id))
+}
+
+func (s *Store) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := os.Remove(s.infoPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) list() ([]Upload, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.info"))
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]Upload, 0, len(files))
+	for _, file := range files {
+		u, err := s.Get(strings.TrimSuffix(filepath.Base(file), ".info"))
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+func (s *Store) ListCompleted() ([]Upload, error) {
+	uploads, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	completed := uploads[:0]
+	for _, u := range uploads {
+		if u.Completed() {
+			completed = append(completed, u)
+		}
+	}
+	return completed, nil
+}
+
+// DeleteExpired removes incomplete uploads whose expiration time has passed.
+func (s *Store) DeleteExpired(now time.Time) (int, error) {
+	uploads, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, u := range uploads {
+		if u.Completed() || u.ExpTime.After(now) {
+			continue
+		}
+		if s.acquire(u.ID) != nil {
+			continue
+		}
+		err = s.Delete(u.ID)
+		s.release(u.ID)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
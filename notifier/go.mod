@@ -2,4 +2,6 @@ module notifier
 
 go 1.13
 
-require github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+require common v0.0.0-00010101000000-000000000000
+
+replace common => ../common
@@ -1,41 +1,89 @@
 package main
 
 import (
-	"encoding/json"
+	"common/auth"
+	"common/config"
+	"common/health"
+	"common/logging"
+	"common/metrics"
+	"common/mq"
+	"common/shutdown"
+	"common/tracing"
+	"context"
 	"log"
-	"notifier/mqclient"
+	"net/http"
 	"notifier/seclient"
 )
 
-type notifyMessage struct {
-	To      string `json:"to"`
-	Message string `json:"message"`
+type Config struct {
+	HTTPAddress  string `env:"HTTP_ADDRESS" default:":8080"`
+	AdminAddress string `env:"ADMIN_ADDRESS"`
+
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+	Provider seclient.Config
+	MQ       mq.Config
+	// Auth checks the permission of the admin requests, it is needed only
+	// with the admin server.
+	Auth *auth.Config `when:"ADMIN_ADDRESS"`
 }
 
 func main() {
-	sc, err := seclient.CreateSeClient()
+	var conf Config
+	config.MustLoad(&conf)
+	err := logging.Setup("notifier", conf.Log)
+	if err != nil {
+		log.Panic(err)
+	}
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("notifier", conf.Tracing)
 	if err != nil {
 		log.Panic(err)
 	}
-	cl, err := mqclient.CreateMqClient()
+	sc := seclient.CreateSeClient(conf.Provider)
+	conf.MQ.Topology = []mq.Queue{mq.SmsMessages}
+	cl, err := mq.CreateClient(conf.MQ)
 	if err != nil {
 		log.Panic(err)
 	}
-	msgs, err := cl.GetMessages()
+	consumer, err := cl.ConsumeSms(cl.Options(), func(ctx context.Context, m mq.SmsMessage) error {
+		err := sc.Send(ctx, m.To, m.Message)
+		metrics.SmsSent(err)
+		return err
+	})
 	if err != nil {
 		log.Panic(err)
 	}
-	log.Println("Notifier service started")
-	for m := range msgs {
-		var nm notifyMessage
-		json.Unmarshal(m.Body, &nm)
-		err := sc.Send(nm.To, nm.Message)
+	go func() {
+		err := consumer.Wait()
 		if err != nil {
-			log.Panic(err)
+			sd.Fail(err)
 		}
-		err = m.Ack(false)
+	}()
+	hc := health.CreateHealth()
+	hc.AddPing("message queue", cl.Ping)
+	mux := http.NewServeMux()
+	hc.Register(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress, Handler: mux})
+	sd.Add("consumer", consumer.Stop)
+	if len(conf.AdminAddress) != 0 {
+		ac, err := auth.CreateAuthClient(*conf.Auth)
 		if err != nil {
 			log.Panic(err)
 		}
+		admin := http.NewServeMux()
+		admin.Handle("/admin/dlq/", cl.AdminHandler("/admin/dlq/", ac.Require("manage")))
+		sd.ServeHTTP("admin server", &http.Server{Addr: conf.AdminAddress, Handler: admin})
+		sd.AddCloser("auth client", func() { ac.Close() })
+	}
+	sd.AddCloser("message queue", func() { cl.Close() })
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Notifier service started")
+	err = sd.Wait()
+	if err != nil {
+		log.Panic(err)
 	}
 }
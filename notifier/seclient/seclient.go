@@ -1,32 +1,35 @@
 package seclient
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
-	"os"
+	"net/url"
+
+	"common/logging"
+	"common/tracing"
 )
 
+type Config struct {
+	Address string `env:"EMAIL_PROVIDER_ADDRESS" required:"true"`
+	ApiId   string `env:"PROVIDER_API_ID" required:"true" secret:"true"`
+}
+
 type Client struct {
 	address string
 	apiId   string
 	client  http.Client
 }
 
-func CreateSeClient() (Client, error) {
-	var client Client
-	client.address = os.Getenv("EMAIL_PROVIDER_ADDRESS")
-	client.apiId = os.Getenv("PROVIDER_API_ID")
-	if len(client.address) == 0 {
-		return client, errors.New("Email provider address is not specified")
-	}
-	if len(client.apiId) == 0 {
-		return client, errors.New("Provider api_id is not specified")
-	}
-	return client, nil
+func CreateSeClient(conf Config) Client {
+	client := Client{address: conf.Address, apiId: conf.ApiId}
+	client.client.Transport = tracing.Transport(logging.Transport{Base: http.DefaultTransport})
+	return client
 }
 
-func (c *Client) Send(to string, msg string) error {
-	req, err := http.NewRequest("GET", c.address, nil)
+func (c *Client) Send(ctx context.Context, to string, msg string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.address, nil)
 	if err != nil {
 		return err
 	}
@@ -38,8 +41,14 @@ func (c *Client) Send(to string, msg string) error {
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return err
+		// url.Error quotes the whole URL with the api id, the phone number
+		// and the message, the error ends up in logs and message headers.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("Send request failed: %v", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return errors.New("Send request failed")
 	}
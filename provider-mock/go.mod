@@ -1,3 +1,7 @@
 module provider-mock
 
 go 1.13
+
+require common v0.0.0-00010101000000-000000000000
+
+replace common => ../common
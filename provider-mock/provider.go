@@ -5,6 +5,14 @@ import (
 	"errors"
 	"log"
 	"net/http"
+
+	"common/config"
+	"common/health"
+	"common/httpx"
+	"common/logging"
+	"common/metrics"
+	"common/shutdown"
+	"common/tracing"
 )
 
 type okResponse struct {
@@ -23,13 +31,14 @@ type errorResponse struct {
 	Error      string `json:"error"`
 }
 
+// respondWithError mimics the provider API, which reports errors with 200 OK
+// and its own status codes in the body.
 func respondWithError(w http.ResponseWriter, err error, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(errorResponse{"Error", statusCode, err.Error()})
 }
 
 func sendHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.URL.String())
 	params := r.URL.Query()
 	if params["msg"] == nil || len(params["msg"]) != 1 {
 		respondWithError(w, errors.New("Message is not specified"), 203)
@@ -40,14 +49,47 @@ func sendHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, errors.New("Recipient is not specified"), 202)
 		return
 	}
-	for _, to := range params["to"] {
-		log.Printf("To: %s, Message: '%s'", to, msg)
-	}
+	// Recipients and texts carry phone numbers and confirmation tokens, so
+	// only their sizes get into the log.
+	logging.FromContext(r.Context()).Info("Message sent", logging.Fields{
+		"recipients": len(params["to"]),
+		"length":     len(msg),
+	})
 	respondOK(w, okResponse{"OK", 100})
 }
 
+type Config struct {
+	HTTPAddress string `env:"HTTP_ADDRESS" default:":8080"`
+
+	Log      logging.Config
+	Tracing  tracing.Config
+	Shutdown shutdown.Config
+}
+
 func main() {
-	http.HandleFunc("/send", sendHandler)
-	log.Println("Provider-mock started")
-	log.Panic(http.ListenAndServe(":8080", nil))
+	var conf Config
+	config.MustLoad(&conf)
+	err := logging.Setup("provider-mock", conf.Log)
+	if err != nil {
+		log.Panic(err)
+	}
+	sd := shutdown.CreateShutdown(conf.Shutdown)
+	tr, err := tracing.Setup("provider-mock", conf.Tracing)
+	if err != nil {
+		log.Panic(err)
+	}
+	router := httpx.CreateRouter()
+	router.Get("/send", sendHandler)
+	http.Handle("/", router)
+	hc := health.CreateHealth()
+	hc.Register(http.DefaultServeMux)
+	http.Handle("/metrics", metrics.Handler())
+	sd.Drain("readiness", hc.Stop)
+	sd.ServeHTTP("http server", &http.Server{Addr: conf.HTTPAddress})
+	sd.AddCloser("tracing", tr.Close)
+	logging.Info("Provider-mock started")
+	err = sd.Wait()
+	if err != nil {
+		log.Panic(err)
+	}
 }